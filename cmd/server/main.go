@@ -4,10 +4,12 @@ import (
         "log"
         "net/http"
         "os"
+        "strconv"
 
         "toon-db/internal/db"
         "toon-db/internal/handlers"
         "toon-db/internal/parser"
+        "toon-db/internal/tokenizer"
 
         "github.com/gorilla/mux"
 )
@@ -27,11 +29,32 @@ func main() {
         }
         defer database.Close()
 
-        // Initialize TOON parser
+        // Initialize TOON parser, with limits that keep a single client's
+        // documents from exhausting the server. Zero disables a limit.
         toonParser := parser.NewParser()
+        toonParser.SetLimits(parser.Limits{
+                MaxDepth:         envInt("MAX_DEPTH", 64),
+                MaxKeys:          envInt("MAX_KEYS", 10000),
+                MaxArrayLength:   envInt("MAX_ARRAY_LENGTH", 1000000),
+                MaxLineLength:    envInt("MAX_LINE_LENGTH", 1<<20),
+                MaxDocumentBytes: envInt("MAX_DOCUMENT_BYTES", 8<<20),
+        })
 
-        // Initialize handlers
+        // Initialize handlers. The body cap also applies to backups sent to
+        // /api/restore, so it is larger than a single document may be.
         handler := handlers.NewHandler(database, toonParser, apiKey)
+        handler.SetBodyLimit(int64(envInt("MAX_BODY_BYTES", 32<<20)))
+
+        // Count tokens with a local vocabulary, such as cl100k_base.tiktoken,
+        // if one is given, and estimate them otherwise
+        if path := os.Getenv("TOKENIZER_VOCAB"); path != "" {
+                vocab, err := tokenizer.Load(path)
+                if err != nil {
+                        log.Fatal("Failed to load tokenizer vocabulary:", err)
+                }
+                handler.SetTokenizer(vocab)
+                log.Printf("Tokenizer vocabulary %s loaded (%d tokens)", vocab.Name(), vocab.Size())
+        }
 
         // Setup router
         router := mux.NewRouter()
@@ -39,6 +62,7 @@ func main() {
         // API routes
         api := router.PathPrefix("/api").Subrouter()
         api.Use(handler.AuthMiddleware)
+        api.Use(handler.BodyLimitMiddleware)
         
         api.HandleFunc("/auth", handler.AuthHandler).Methods("GET")
         api.HandleFunc("/collections", handler.GetCollectionsHandler).Methods("GET")
@@ -46,9 +70,20 @@ func main() {
         api.HandleFunc("/collections/{collection}", handler.DeleteCollectionHandler).Methods("DELETE")
         api.HandleFunc("/{collection}/{key}", handler.GetHandler).Methods("GET")
         api.HandleFunc("/{collection}/{key}", handler.UpsertHandler).Methods("POST")
+        api.HandleFunc("/{collection}/{key}", handler.PatchHandler).Methods("PATCH")
         api.HandleFunc("/{collection}/{key}", handler.DeleteHandler).Methods("DELETE")
+        api.HandleFunc("/{collection}/{key}/rows/{field}", handler.AppendRowsHandler).Methods("POST")
+        api.HandleFunc("/{collection}/{key}/rows/{field}", handler.RemoveRowsHandler).Methods("DELETE")
+        api.HandleFunc("/{collection}/{key}/rows/{field}", handler.UpdateRowsHandler).Methods("PATCH")
+        api.HandleFunc("/{collection}/{key}/fields/{field}.csv", handler.ExportCSVHandler).Methods("GET")
+        api.HandleFunc("/{collection}/{key}/fields/{field}.csv", handler.ImportCSVHandler).Methods("PUT")
+        api.HandleFunc("/{collection}/{key}/tokens", handler.TokensHandler).Methods("GET")
+        api.HandleFunc("/tokens", handler.TokenTotalsHandler).Methods("GET")
         api.HandleFunc("/backup", handler.BackupHandler).Methods("GET")
         api.HandleFunc("/restore", handler.RestoreHandler).Methods("POST")
+        api.HandleFunc("/convert", handler.ConvertHandler).Methods("POST")
+        api.HandleFunc("/diff", handler.DiffHandler).Methods("POST")
+        api.HandleFunc("/context", handler.ContextHandler).Methods("POST")
 
         // Static files
         router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("web/static/"))))
@@ -72,4 +107,19 @@ func main() {
 
         log.Printf("Server starting on port %s...", port)
         log.Fatal(http.ListenAndServe(":"+port, router))
-}
\ No newline at end of file
+}
+
+// envInt reads a non-negative number from the environment variable name,
+// or returns def if it is not set.
+func envInt(name string, def int) int {
+        value := os.Getenv(name)
+        if value == "" {
+                return def
+        }
+
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 0 {
+                log.Fatalf("Invalid %s: expected a non-negative number, got %q", name, value)
+        }
+        return n
+}
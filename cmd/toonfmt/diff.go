@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffCells bounds the table used to align changed lines. Larger changes
+// are shown as every old line removed and every new line added.
+const maxDiffCells = 4 << 20
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+type opKind byte
+
+const (
+	opEqual  opKind = ' '
+	opDelete opKind = '-'
+	opInsert opKind = '+'
+)
+
+type diffOp struct {
+	kind opKind
+	line string
+}
+
+// unifiedDiff returns the changes from a to b in unified diff format.
+func unifiedDiff(oldName, newName, a, b string) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+
+	// Old and new line numbers of ops[i], 1-based
+	oldLine := make([]int, len(ops)+1)
+	newLine := make([]int, len(ops)+1)
+	oldLine[0], newLine[0] = 1, 1
+	for i, op := range ops {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if op.kind != opInsert {
+			oldLine[i+1]++
+		}
+		if op.kind != opDelete {
+			newLine[i+1]++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == opEqual {
+			i++
+			continue
+		}
+
+		// Extend the hunk while changes are close enough to share context
+		start := max(i-diffContext, 0)
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != opEqual {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		end = min(end+diffContext, len(ops))
+
+		oldCount := oldLine[end] - oldLine[start]
+		newCount := newLine[end] - newLine[start]
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(oldLine[start], oldCount), hunkRange(newLine[start], newCount))
+		for _, op := range ops[start:end] {
+			out.WriteByte(byte(op.kind))
+			out.WriteString(op.line)
+			out.WriteByte('\n')
+		}
+
+		i = end
+	}
+
+	return out.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// An empty range names the line before it
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines aligns a and b on their longest common subsequence of lines.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+
+	// Lines shared at the start and end need no alignment
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{opEqual, line})
+	}
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(midA)+1)*(len(midB)+1) > maxDiffCells {
+		for _, line := range midA {
+			ops = append(ops, diffOp{opDelete, line})
+		}
+		for _, line := range midB {
+			ops = append(ops, diffOp{opInsert, line})
+		}
+	} else {
+		ops = append(ops, lcsOps(midA, midB)...)
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{opEqual, line})
+	}
+	return ops
+}
+
+func lcsOps(a, b []string) []diffOp {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{opEqual, a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{opDelete, a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{opInsert, b[j]})
+			j++
+		}
+	}
+	return ops
+}
@@ -0,0 +1,166 @@
+// Command toonfmt formats TOON documents.
+//
+// Without an explicit path it formats standard input. Given a file it
+// formats the file, and given a directory it formats every .toon file in
+// it, recursively. By default the formatted documents are printed to
+// standard output.
+//
+// Formatting normalizes indentation and quoting and recounts array lengths.
+// Comments, blank lines and the order of fields are kept.
+//
+// Usage:
+//
+//	toonfmt [flags] [path ...]
+//
+// The flags are:
+//
+//	-d
+//		Do not print formatted documents. Print diffs to standard output
+//		for documents whose formatting differs.
+//	-l
+//		Do not print formatted documents. Print the names of files whose
+//		formatting differs.
+//	-w
+//		Do not print formatted documents. Write the result back to the
+//		source file instead.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"toon-db/internal/parser"
+)
+
+var (
+	list  = flag.Bool("l", false, "list files whose formatting differs from toonfmt's")
+	write = flag.Bool("w", false, "write result to (source) file instead of stdout")
+	diff  = flag.Bool("d", false, "display diffs instead of rewriting files")
+)
+
+var exitCode = 0
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: toonfmt [flags] [path ...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	p := parser.NewParser()
+
+	if flag.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "toonfmt: cannot use -w with standard input")
+			os.Exit(2)
+		}
+		if err := processFile(p, "<standard input>", os.Stdin, os.Stdout); err != nil {
+			report(err)
+		}
+		os.Exit(exitCode)
+	}
+
+	for _, path := range flag.Args() {
+		info, err := os.Stat(path)
+		if err != nil {
+			report(err)
+			continue
+		}
+
+		if !info.IsDir() {
+			if err := processPath(p, path); err != nil {
+				report(err)
+			}
+			continue
+		}
+
+		err = filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !strings.HasSuffix(d.Name(), ".toon") {
+				return nil
+			}
+			if err := processPath(p, path); err != nil {
+				report(err)
+			}
+			return nil
+		})
+		if err != nil {
+			report(err)
+		}
+	}
+
+	os.Exit(exitCode)
+}
+
+func report(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	exitCode = 2
+}
+
+func processPath(p *parser.Parser, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return processFile(p, path, f, os.Stdout)
+}
+
+// processFile formats the document read from in, named filename, and
+// writes the result to out or back to the file, as the flags ask.
+func processFile(p *parser.Parser, filename string, in io.Reader, out io.Writer) error {
+	src, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	doc, err := p.ParseDocument(string(src))
+	if err != nil {
+		var parseErr *parser.ParseError
+		if errors.As(err, &parseErr) {
+			var msgs []string
+			for _, d := range parseErr.Diagnostics {
+				msgs = append(msgs, fmt.Sprintf("%s:%d:%d: %s", filename, d.Line, d.Column, d.Message))
+			}
+			return errors.New(strings.Join(msgs, "\n"))
+		}
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	res := doc.String()
+	if !*list && !*write && !*diff {
+		_, err = io.WriteString(out, res)
+		return err
+	}
+
+	if res == string(src) {
+		return nil
+	}
+
+	if *list {
+		fmt.Fprintln(out, filename)
+	}
+	if *write {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filename, []byte(res), info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if *diff {
+		io.WriteString(out, unifiedDiff(filename+".orig", filename, string(src), res))
+	}
+
+	return nil
+}
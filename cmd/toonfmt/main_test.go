@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"toon-db/internal/parser"
+)
+
+// format runs processFile on the document at path with the given flags set,
+// and returns what it printed.
+func format(t *testing.T, path string, flags ...*bool) (string, error) {
+	t.Helper()
+	for _, flag := range flags {
+		*flag = true
+		defer func(flag *bool) { *flag = false }(flag)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var out strings.Builder
+	err = processFile(parser.NewParser(), path, f, &out)
+	return out.String(), err
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// copyFile copies the file at path into a temporary directory and returns
+// the path of the copy.
+func copyFile(t *testing.T, path string) string {
+	t.Helper()
+	dst := filepath.Join(t.TempDir(), filepath.Base(path))
+	if err := os.WriteFile(dst, []byte(readFile(t, path)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+func TestFormat(t *testing.T) {
+	golden := readFile(t, "testdata/messy.golden")
+
+	got, err := format(t, "testdata/messy.toon")
+	if err != nil || got != golden {
+		t.Fatalf("got\n%s%v\nwant\n%s", got, err, golden)
+	}
+
+	// Formatting is idempotent
+	got, err = format(t, "testdata/messy.golden")
+	if err != nil || got != golden {
+		t.Fatalf("formatting the golden file gave\n%s%v", got, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	got, err := format(t, "testdata/messy.toon", list)
+	if err != nil || got != "testdata/messy.toon\n" {
+		t.Fatalf("-l printed %q, %v", got, err)
+	}
+	got, err = format(t, "testdata/messy.golden", list)
+	if err != nil || got != "" {
+		t.Fatalf("-l printed %q for a formatted file, %v", got, err)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	path := copyFile(t, "testdata/messy.toon")
+	got, err := format(t, path, write)
+	if err != nil || got != "" {
+		t.Fatalf("-w printed %q, %v", got, err)
+	}
+	if got, want := readFile(t, path), readFile(t, "testdata/messy.golden"); got != want {
+		t.Fatalf("-w wrote\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	got, err := format(t, "testdata/messy.toon", diff)
+	if want := readFile(t, "testdata/messy.diff"); err != nil || got != want {
+		t.Fatalf("-d printed\n%s%v\nwant\n%s", got, err, want)
+	}
+	got, err = format(t, "testdata/messy.golden", diff)
+	if err != nil || got != "" {
+		t.Fatalf("-d printed %q for a formatted file, %v", got, err)
+	}
+}
+
+func TestInvalidDocument(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.toon")
+	if err := os.WriteFile(path, []byte("tags[3]: a,b\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := format(t, path, write)
+	if err == nil || !strings.HasPrefix(err.Error(), path+":1:1: ") {
+		t.Fatalf("got %v, want an error at %s:1:1", err, path)
+	}
+	if readFile(t, path) != "tags[3]: a,b\n" {
+		t.Fatal("-w rewrote a document that does not parse")
+	}
+}
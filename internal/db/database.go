@@ -1,15 +1,33 @@
 package db
 
 import (
+        "errors"
         "fmt"
+        "hash/fnv"
         "log"
         "strings"
+        "sync"
 
         "github.com/dgraph-io/badger/v3"
 )
 
+// ErrKeyNotFound is returned when a key does not exist in its collection.
+var ErrKeyNotFound = errors.New("key not found")
+
+// maxUpdateAttempts is how many times Update retries a transaction that
+// conflicts with a concurrent write before giving up.
+const maxUpdateAttempts = 10
+
+// updateLocks is the number of locks Update spreads keys over.
+const updateLocks = 64
+
 type Database struct {
         db *badger.DB
+
+        // locks serialize the updates of a key within this process, so that
+        // many updates of one key, such as appends to a log, queue up
+        // instead of conflicting until they run out of attempts.
+        locks [updateLocks]sync.Mutex
 }
 
 type Record struct {
@@ -49,12 +67,61 @@ func (d *Database) Get(collection, key string) (string, error) {
         })
 
         if err == badger.ErrKeyNotFound {
-                return "", fmt.Errorf("key not found")
+                return "", ErrKeyNotFound
         }
 
         return data, err
 }
 
+// Update replaces the data stored under key with the result of fn applied
+// to it, in a single transaction: if another write to the key commits in
+// between, the transaction is retried with the new data, so no write is
+// lost. An error from fn aborts the update and is returned as is. Update
+// returns ErrKeyNotFound if the key does not exist.
+func (d *Database) Update(collection, key string, fn func(data string) (string, error)) error {
+        dbKey := []byte(fmt.Sprintf("%s:%s", collection, key))
+
+        mu := d.lock(dbKey)
+        mu.Lock()
+        defer mu.Unlock()
+
+        var err error
+        for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+                err = d.db.Update(func(txn *badger.Txn) error {
+                        item, err := txn.Get(dbKey)
+                        if err != nil {
+                                return err
+                        }
+
+                        data, err := item.ValueCopy(nil)
+                        if err != nil {
+                                return err
+                        }
+
+                        updated, err := fn(string(data))
+                        if err != nil {
+                                return err
+                        }
+                        return txn.Set(dbKey, []byte(updated))
+                })
+                if err != badger.ErrConflict {
+                        break
+                }
+        }
+
+        if err == badger.ErrKeyNotFound {
+                return ErrKeyNotFound
+        }
+        return err
+}
+
+// lock returns the lock that serializes updates of dbKey.
+func (d *Database) lock(dbKey []byte) *sync.Mutex {
+        h := fnv.New32a()
+        h.Write(dbKey)
+        return &d.locks[h.Sum32()%updateLocks]
+}
+
 func (d *Database) Set(collection, key, data string) error {
         return d.db.Update(func(txn *badger.Txn) error {
                 return txn.Set([]byte(fmt.Sprintf("%s:%s", collection, key)), []byte(data))
@@ -171,6 +238,36 @@ func (d *Database) Backup() ([]Record, error) {
         return records, err
 }
 
+// Scan calls fn for every record with its version, which changes whenever
+// the record is written. The value of a record is only read if fn calls
+// value, so that a caller that has already seen a version pays nothing to
+// skip it.
+func (d *Database) Scan(fn func(collection, key string, version uint64, value func() (string, error)) error) error {
+        return d.db.View(func(txn *badger.Txn) error {
+                opts := badger.DefaultIteratorOptions
+                opts.PrefetchValues = false
+                it := txn.NewIterator(opts)
+                defer it.Close()
+
+                for it.Rewind(); it.Valid(); it.Next() {
+                        item := it.Item()
+                        parts := strings.Split(string(item.Key()), ":")
+                        if len(parts) != 2 {
+                                continue
+                        }
+
+                        value := func() (string, error) {
+                                val, err := item.ValueCopy(nil)
+                                return string(val), err
+                        }
+                        if err := fn(parts[0], parts[1], item.Version(), value); err != nil {
+                                return err
+                        }
+                }
+                return nil
+        })
+}
+
 func (d *Database) Restore(records []Record) error {
         return d.db.Update(func(txn *badger.Txn) error {
                 for _, record := range records {
@@ -1,23 +1,38 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"toon-db/internal/db"
 	"toon-db/internal/parser"
+	"toon-db/internal/tokenizer"
 
 	"github.com/gorilla/mux"
 )
 
 type Handler struct {
-	database *db.Database
-	parser   *parser.Parser
-	apiKey   string
+	database     *db.Database
+	parser       *parser.Parser
+	tokenizer    *tokenizer.Tokenizer
+	apiKey       string
+	maxBodyBytes int64
+
+	// counted caches the token counts of each record for
+	// TokenTotalsHandler, by collection and key.
+	countedMu sync.Mutex
+	counted   map[string]countedRecord
 }
 
 type AuthResponse struct {
@@ -25,6 +40,14 @@ type AuthResponse struct {
 	Message string `json:"message"`
 }
 
+// delimiters maps the values of the delimiter query parameter to the
+// delimiter they select.
+var delimiters = map[string]byte{
+	"comma": ',',
+	"tab":   '\t',
+	"pipe":  '|',
+}
+
 type APIResponse struct {
 	Success bool        `json:"success"`
 	Data    interface{} `json:"data,omitempty"`
@@ -33,9 +56,10 @@ type APIResponse struct {
 
 func NewHandler(database *db.Database, parser *parser.Parser, apiKey string) *Handler {
 	return &Handler{
-		database: database,
-		parser:   parser,
-		apiKey:   apiKey,
+		database:  database,
+		parser:    parser,
+		tokenizer: tokenizer.New(),
+		apiKey:    apiKey,
 	}
 }
 
@@ -57,6 +81,35 @@ func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// SetBodyLimit caps request bodies at n bytes. Larger requests are rejected
+// by BodyLimitMiddleware with 413 Request Entity Too Large. Zero means no
+// cap.
+func (h *Handler) SetBodyLimit(n int64) {
+	h.maxBodyBytes = n
+}
+
+// SetTokenizer sets the tokenizer that token counts are made with, in
+// place of the estimate used without a vocabulary.
+func (h *Handler) SetTokenizer(t *tokenizer.Tokenizer) {
+	h.tokenizer = t
+}
+
+func (h *Handler) BodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.maxBodyBytes > 0 {
+			// Refuse declared oversized bodies up front, and stop reading
+			// the others once they pass the cap
+			if r.ContentLength > h.maxBodyBytes {
+				h.respondWithBodyError(w, &http.MaxBytesError{Limit: h.maxBodyBytes})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (h *Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
@@ -97,9 +150,87 @@ func (h *Handler) GetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "toon"
+	}
+	if format != "toon" && format != "json" {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid format, expected toon or json")
+		return
+	}
+
+	var opts parser.EncodeOptions
+	if name := query.Get("delimiter"); name != "" {
+		delim, ok := delimiters[name]
+		if !ok {
+			h.respondWithError(w, http.StatusBadRequest, "Invalid delimiter, expected comma, tab or pipe")
+			return
+		}
+		opts.Delimiter = delim
+	}
+
+	expr := query.Get("path")
+	if expr == "" && format == "toon" {
+		// Optionally rewrite arrays and tables with another delimiter
+		if opts.Delimiter != 0 {
+			data, err = h.parser.Reformat(data, opts)
+			if err != nil {
+				h.respondWithError(w, http.StatusInternalServerError, "Failed to convert data")
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(data))
+
+		log.Printf("%s | %d | %s | %s | %s | %s | %s",
+			time.Now().Format("15:04:05"),
+			http.StatusOK,
+			time.Since(start),
+			getClientIP(r),
+			r.Method,
+			r.URL.Path,
+			"-")
+		return
+	}
+
+	// Objects keep the order of their keys through the path and encoders
+	value, err := h.parser.ParseOrdered(data)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to parse stored data")
+		return
+	}
+
+	// Select the part of the document named by the path, if any
+	if expr != "" {
+		path, err := parser.CompilePath(expr)
+		if err != nil {
+			h.respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if value, err = path.Eval(value); err != nil {
+			h.respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+	}
+
+	var result []byte
+	if format == "json" {
+		result, err = json.MarshalIndent(value, "", "  ")
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		result, err = parser.MarshalWithOptions(value, opts)
+		w.Header().Set("Content-Type", "text/plain")
+	}
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to convert data")
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(data))
+	w.Write(result)
 
 	log.Printf("%s | %d | %s | %s | %s | %s | %s",
 		time.Now().Format("15:04:05"),
@@ -108,7 +239,7 @@ func (h *Handler) GetHandler(w http.ResponseWriter, r *http.Request) {
 		getClientIP(r),
 		r.Method,
 		r.URL.Path,
-		"-")
+		"path="+expr)
 }
 
 func (h *Handler) UpsertHandler(w http.ResponseWriter, r *http.Request) {
@@ -117,24 +248,95 @@ func (h *Handler) UpsertHandler(w http.ResponseWriter, r *http.Request) {
 	collection := vars["collection"]
 	key := vars["key"]
 
+	// Validate TOON format while the body is read, without building the
+	// document in memory
+	var body bytes.Buffer
+	err := h.parser.Validate(io.TeeReader(r.Body, &body))
+	if err != nil {
+		if !h.respondWithParseError(w, err) {
+			h.respondWithBodyError(w, err)
+		}
+		return
+	}
+
+	toonData := body.String()
+
+	err = h.database.Set(collection, key, toonData)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to save data")
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Data: map[string]string{
+			"collection": collection,
+			"key":        key,
+			"message":    "Data saved successfully",
+		},
+	}
+
+	h.respondWithJSON(w, http.StatusOK, response)
+
+	log.Printf("%s | %d | %s | %s | %s | %s | %s",
+		time.Now().Format("15:04:05"),
+		http.StatusOK,
+		time.Since(start),
+		getClientIP(r),
+		r.Method,
+		r.URL.Path,
+		"-")
+}
+
+// PatchHandler applies a merge patch to a stored document: fields in the
+// patch are set, fields set to null are deleted, and nested objects are
+// merged. The patch is TOON, or JSON when sent with a JSON content type.
+func (h *Handler) PatchHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+	key := vars["key"]
+
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "Failed to read request body")
+		h.respondWithBodyError(w, err)
 		return
 	}
 
-	toonData := string(body)
+	patchTOON := string(body)
+	if isJSONContentType(r.Header.Get("Content-Type")) {
+		patchTOON, err = h.parser.JSONToTOON(patchTOON)
+		if err != nil {
+			h.respondWithError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+	}
 
-	// Validate TOON format
-	_, err = h.parser.ParseToon(toonData)
+	patch, err := h.parser.ParseDocument(patchTOON)
 	if err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "Invalid TOON format")
+		if !h.respondWithParseError(w, err) {
+			h.respondWithError(w, http.StatusBadRequest, "Invalid patch: "+err.Error())
+		}
 		return
 	}
 
-	err = h.database.Set(collection, key, toonData)
+	err = h.database.Update(collection, key, func(data string) (string, error) {
+		doc, err := h.parser.ParseDocument(data)
+		if err != nil {
+			return "", err
+		}
+		doc.MergePatch(patch)
+		return h.checkLimits(doc.String())
+	})
+	if errors.Is(err, db.ErrKeyNotFound) {
+		h.respondWithError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+	if h.respondWithLimitError(w, err) {
+		return
+	}
 	if err != nil {
-		h.respondWithError(w, http.StatusInternalServerError, "Failed to save data")
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to patch data")
 		return
 	}
 
@@ -143,7 +345,7 @@ func (h *Handler) UpsertHandler(w http.ResponseWriter, r *http.Request) {
 		Data: map[string]string{
 			"collection": collection,
 			"key":        key,
-			"message":    "Data saved successfully",
+			"message":    "Data patched successfully",
 		},
 	}
 
@@ -159,24 +361,698 @@ func (h *Handler) UpsertHandler(w http.ResponseWriter, r *http.Request) {
 		"-")
 }
 
+// requestError is an error caused by the request rather than the server,
+// reported with 400 Bad Request.
+type requestError struct {
+	err error
+}
+
+func (e requestError) Error() string {
+	return e.err.Error()
+}
+
+// limitError is an edited document that exceeds the limits of the parser,
+// reported with 413 Request Entity Too Large.
+type limitError struct {
+	diag parser.Diagnostic
+}
+
+func (e limitError) Error() string {
+	return e.diag.Message
+}
+
+// checkLimits reads an edited document with the limits set on the parser
+// before it is stored, so that a record cannot grow past them one edit at a
+// time. It returns doc, or a limitError for the limit exceeded.
+func (h *Handler) checkLimits(doc string) (string, error) {
+	var parseErr *parser.ParseError
+	if !errors.As(h.parser.Validate(strings.NewReader(doc)), &parseErr) {
+		return doc, nil
+	}
+	// Only a limit rejects the edit: problems the stored document already
+	// had are kept, as when it was written
+	if n := len(parseErr.Diagnostics); n > 0 && parseErr.Diagnostics[n-1].Reason == parser.ReasonLimitExceeded {
+		return "", limitError{parseErr.Diagnostics[n-1]}
+	}
+	return doc, nil
+}
+
+// AppendRowsHandler appends rows to a tabular array field of a stored
+// document, creating the field if it does not exist. The body holds one row
+// as an object, or several as an array of objects, in TOON or JSON.
+func (h *Handler) AppendRowsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := h.readValue(r)
+	if err != nil {
+		h.respondWithBodyError(w, err)
+		return
+	}
+
+	rows, ok := rowObjects(body)
+	if !ok {
+		h.respondWithError(w, http.StatusBadRequest, "Expected a row object or an array of row objects")
+		return
+	}
+
+	h.editTable(w, r, "appended", true, func(t *parser.Table) (int, error) {
+		for i, row := range rows {
+			if err := t.Append(row); err != nil {
+				return 0, fmt.Errorf("row %d: %v", i, err)
+			}
+		}
+		return len(rows), nil
+	})
+}
+
+// RemoveRowsHandler removes rows from a tabular array field of a stored
+// document: those at the positions given by index parameters, counting
+// from the end when negative, or those matching every where condition.
+func (h *Handler) RemoveRowsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	conditions, err := conditionsFromQuery(query)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var indexes []int
+	for _, value := range query["index"] {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			h.respondWithError(w, http.StatusBadRequest, "Invalid index, expected a number")
+			return
+		}
+		indexes = append(indexes, i)
+	}
+
+	if len(indexes) == 0 && len(conditions) == 0 {
+		h.respondWithError(w, http.StatusBadRequest, "Give the rows to remove with index or where parameters")
+		return
+	}
+
+	h.editTable(w, r, "removed", false, func(t *parser.Table) (int, error) {
+		n := t.Len()
+		drop := make(map[int]bool)
+		for _, index := range indexes {
+			i := index
+			if i < 0 {
+				i += n
+			}
+			if i < 0 || i >= n {
+				return 0, fmt.Errorf("index %d is out of range, the table has %d rows", index, n)
+			}
+			drop[i] = true
+		}
+
+		return t.RemoveFunc(func(i int, row map[string]interface{}) bool {
+			return drop[i] || (len(conditions) > 0 && matchAll(conditions, row))
+		}), nil
+	})
+}
+
+// UpdateRowsHandler sets fields of the rows of a tabular array field that
+// match every where condition. The body is an object of the fields to set,
+// in TOON or JSON.
+func (h *Handler) UpdateRowsHandler(w http.ResponseWriter, r *http.Request) {
+	conditions, err := conditionsFromQuery(r.URL.Query())
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(conditions) == 0 {
+		h.respondWithError(w, http.StatusBadRequest, "Give the rows to update with where parameters")
+		return
+	}
+
+	body, err := h.readValue(r)
+	if err != nil {
+		h.respondWithBodyError(w, err)
+		return
+	}
+	set, ok := body.(map[string]interface{})
+	if !ok {
+		h.respondWithError(w, http.StatusBadRequest, "Expected an object of the fields to set")
+		return
+	}
+
+	h.editTable(w, r, "updated", false, func(t *parser.Table) (int, error) {
+		return t.UpdateFunc(func(i int, row map[string]interface{}) map[string]interface{} {
+			if !matchAll(conditions, row) {
+				return nil
+			}
+			return set
+		})
+	})
+}
+
+// editTable applies edit to the tabular array named by the field route
+// variable, a dotted path of keys, in a single transaction. edit returns
+// how many rows it changed, which is reported under the name count. If
+// create is set, a missing field is created as an empty array first.
+func (h *Handler) editTable(w http.ResponseWriter, r *http.Request, count string, create bool, edit func(t *parser.Table) (int, error)) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+	key := vars["key"]
+	field := vars["field"]
+	path := strings.Split(field, ".")
+
+	var changed, rows int
+	err := h.database.Update(collection, key, func(data string) (string, error) {
+		doc, err := h.parser.ParseDocument(data)
+		if err != nil {
+			return "", err
+		}
+
+		if create && doc.Field(path...) == nil {
+			if err := doc.Set(path, []interface{}{}); err != nil {
+				return "", requestError{err}
+			}
+		}
+
+		table, err := doc.Table(path...)
+		if err != nil {
+			return "", requestError{err}
+		}
+		if changed, err = edit(table); err != nil {
+			return "", requestError{err}
+		}
+
+		rows = table.Len()
+		return h.checkLimits(doc.String())
+	})
+
+	var reqErr requestError
+	switch {
+	case errors.Is(err, db.ErrKeyNotFound):
+		h.respondWithError(w, http.StatusNotFound, "Key not found")
+		return
+	case errors.As(err, &reqErr):
+		h.respondWithError(w, http.StatusBadRequest, reqErr.Error())
+		return
+	case h.respondWithLimitError(w, err):
+		return
+	case err != nil:
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to save data")
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"collection": collection,
+			"key":        key,
+			"field":      field,
+			count:        changed,
+			"rows":       rows,
+		},
+	}
+
+	h.respondWithJSON(w, http.StatusOK, response)
+
+	log.Printf("%s | %d | %s | %s | %s | %s | %s",
+		time.Now().Format("15:04:05"),
+		http.StatusOK,
+		time.Since(start),
+		getClientIP(r),
+		r.Method,
+		r.URL.Path,
+		fmt.Sprintf("%s=%d", count, changed))
+}
+
+// readValue reads the request body as a TOON document, or as JSON when sent
+// with a JSON content type, and returns its value. Errors in the document
+// are returned as requestError.
+func (h *Handler) readValue(r *http.Request) (interface{}, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if isJSONContentType(r.Header.Get("Content-Type")) {
+		var value interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&value); err != nil {
+			return nil, requestError{fmt.Errorf("Invalid JSON: %v", err)}
+		}
+		return value, nil
+	}
+
+	doc, err := h.parser.ParseToonWithOptions(string(body), parser.DecodeOptions{Strict: true})
+	if err != nil {
+		return nil, requestError{fmt.Errorf("Invalid TOON format: %v", err)}
+	}
+	return doc.Value, nil
+}
+
+// rowObjects returns the rows held by a request body: a single object, or
+// an array of objects.
+func rowObjects(value interface{}) ([]map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{v}, true
+	case []map[string]interface{}:
+		return v, true
+	case []interface{}:
+		rows := make([]map[string]interface{}, len(v))
+		for i, item := range v {
+			row, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			rows[i] = row
+		}
+		return rows, true
+	}
+	return nil, false
+}
+
+// conditionsFromQuery parses the where parameters, such as where=status=paid
+// or where=total>100, which rows must all satisfy.
+func conditionsFromQuery(query url.Values) ([]parser.Condition, error) {
+	var conditions []parser.Condition
+	for _, expr := range query["where"] {
+		c, err := parser.ParseCondition(expr)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+func matchAll(conditions []parser.Condition, row map[string]interface{}) bool {
+	for _, c := range conditions {
+		if !c.Match(row) {
+			return false
+		}
+	}
+	return true
+}
+
+// ExportCSVHandler returns a tabular array field of a stored document as
+// CSV, with a header row of its field names.
+func (h *Handler) ExportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+	key := vars["key"]
+	field := vars["field"]
+
+	data, err := h.database.Get(collection, key)
+	if err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+
+	doc, err := h.parser.ParseDocument(data)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to parse stored data")
+		return
+	}
+	table, err := doc.Table(strings.Split(field, ".")...)
+	if err != nil {
+		h.respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := table.WriteCSV(&buf); err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to convert data")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", key+"-"+field+".csv"))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+
+	log.Printf("%s | %d | %s | %s | %s | %s | %s",
+		time.Now().Format("15:04:05"),
+		http.StatusOK,
+		time.Since(start),
+		getClientIP(r),
+		r.Method,
+		r.URL.Path,
+		fmt.Sprintf("rows=%d", table.Len()))
+}
+
+// ImportCSVHandler replaces the rows of a tabular array field of a stored
+// document with those of a CSV body, whose header row names the fields. The
+// field is created if it does not exist.
+func (h *Handler) ImportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.respondWithBodyError(w, err)
+		return
+	}
+
+	h.editTable(w, r, "imported", true, func(t *parser.Table) (int, error) {
+		if err := t.ReadCSV(bytes.NewReader(body)); err != nil {
+			return 0, err
+		}
+		return t.Len(), nil
+	})
+}
+
+// tokenCounts are the tokens a document takes in a prompt as stored, as
+// compact JSON and as indented JSON.
+type tokenCounts struct {
+	TOON       int `json:"toon"`
+	JSON       int `json:"json"`
+	PrettyJSON int `json:"json_pretty"`
+}
+
+// countedRecord is the token counts of a record as of a version of it. ok is
+// false for a record that could not be counted.
+type countedRecord struct {
+	version uint64
+	counts  tokenCounts
+	ok      bool
+}
+
+func (h *Handler) countTokens(data string) (tokenCounts, error) {
+	pretty, err := h.parser.ToonToJSON(data)
+	if err != nil {
+		return tokenCounts{}, err
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(pretty)); err != nil {
+		return tokenCounts{}, err
+	}
+
+	return tokenCounts{
+		TOON:       h.tokenizer.Count(data),
+		JSON:       h.tokenizer.Count(compact.String()),
+		PrettyJSON: h.tokenizer.Count(pretty),
+	}, nil
+}
+
+// savedPercent returns the share of the tokens of the JSON form that TOON
+// saves, as a percentage with one decimal.
+func savedPercent(toon, other int) float64 {
+	if other == 0 {
+		return 0
+	}
+	return math.Round(1000*float64(other-toon)/float64(other)) / 10
+}
+
+// TokensHandler counts the tokens of a stored document as TOON and as the
+// equivalent compact and indented JSON, and how many TOON saves.
+func (h *Handler) TokensHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+	key := vars["key"]
+
+	data, err := h.database.Get(collection, key)
+	if err != nil {
+		h.respondWithError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+
+	counts, err := h.countTokens(data)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to convert data")
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"collection": collection,
+			"key":        key,
+			"tokenizer":  h.tokenizer.Name(),
+			"tokens":     counts,
+			"savings": map[string]float64{
+				"json":        savedPercent(counts.TOON, counts.JSON),
+				"json_pretty": savedPercent(counts.TOON, counts.PrettyJSON),
+			},
+		},
+	}
+
+	h.respondWithJSON(w, http.StatusOK, response)
+
+	log.Printf("%s | %d | %s | %s | %s | %s | %s",
+		time.Now().Format("15:04:05"),
+		http.StatusOK,
+		time.Since(start),
+		getClientIP(r),
+		r.Method,
+		r.URL.Path,
+		fmt.Sprintf("toon=%d json=%d", counts.TOON, counts.JSON))
+}
+
+// TokenTotalsHandler adds up the token counts of the documents of each
+// collection, for the dashboard of the panel. The counts of each record are
+// kept until it is written again, so a call only tokenizes what changed.
+func (h *Handler) TokenTotalsHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	type collectionTokens struct {
+		Records int `json:"records"`
+		tokenCounts
+	}
+	totals := make(map[string]*collectionTokens)
+
+	// Only the records written since the last call are read and counted
+	// again; the cache drops the records that are gone
+	h.countedMu.Lock()
+	counted := make(map[string]countedRecord, len(h.counted))
+	recounted := 0
+	err := h.database.Scan(func(collection, key string, version uint64, value func() (string, error)) error {
+		name := collection + ":" + key
+		record, seen := h.counted[name]
+		if !seen || record.version != version {
+			data, err := value()
+			if err != nil {
+				return err
+			}
+			record = countedRecord{version: version}
+			// Documents are validated when written, so one that does not
+			// convert is skipped rather than failing the whole dashboard
+			record.counts, err = h.countTokens(data)
+			record.ok = err == nil
+			recounted++
+		}
+		counted[name] = record
+		if !record.ok {
+			return nil
+		}
+
+		total := totals[collection]
+		if total == nil {
+			total = &collectionTokens{}
+			totals[collection] = total
+		}
+		total.Records++
+		total.TOON += record.counts.TOON
+		total.JSON += record.counts.JSON
+		total.PrettyJSON += record.counts.PrettyJSON
+		return nil
+	})
+	if err == nil {
+		h.counted = counted
+	}
+	h.countedMu.Unlock()
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to read records")
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"tokenizer":   h.tokenizer.Name(),
+			"collections": totals,
+		},
+	}
+
+	h.respondWithJSON(w, http.StatusOK, response)
+
+	log.Printf("%s | %d | %s | %s | %s | %s | %s",
+		time.Now().Format("15:04:05"),
+		http.StatusOK,
+		time.Since(start),
+		getClientIP(r),
+		r.Method,
+		r.URL.Path,
+		fmt.Sprintf("records=%d recounted=%d", len(counted), recounted))
+}
+
 func (h *Handler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	vars := mux.Vars(r)
 	collection := vars["collection"]
 	key := vars["key"]
 
-	err := h.database.Delete(collection, key)
+	err := h.database.Delete(collection, key)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to delete data")
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Data: map[string]string{
+			"collection": collection,
+			"key":        key,
+			"message":    "Data deleted successfully",
+		},
+	}
+
+	h.respondWithJSON(w, http.StatusOK, response)
+
+	log.Printf("%s | %d | %s | %s | %s | %s | %s",
+		time.Now().Format("15:04:05"),
+		http.StatusOK,
+		time.Since(start),
+		getClientIP(r),
+		r.Method,
+		r.URL.Path,
+		"-")
+}
+
+func (h *Handler) GetCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	collections, err := h.database.GetCollections()
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to get collections")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, collections)
+
+	log.Printf("%s | %d | %s | %s | %s | %s | %s",
+		time.Now().Format("15:04:05"),
+		http.StatusOK,
+		time.Since(start),
+		getClientIP(r),
+		r.Method,
+		r.URL.Path,
+		"-")
+}
+
+func (h *Handler) GetCollectionKeysHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+
+	keys, err := h.database.GetCollectionKeys(collection)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to get collection keys")
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"collection": collection,
+			"keys":       keys,
+		},
+	}
+
+	h.respondWithJSON(w, http.StatusOK, response)
+
+	log.Printf("%s | %d | %s | %s | %s | %s | %s",
+		time.Now().Format("15:04:05"),
+		http.StatusOK,
+		time.Since(start),
+		getClientIP(r),
+		r.Method,
+		r.URL.Path,
+		"-")
+}
+
+func (h *Handler) DeleteCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+
+	err := h.database.DeleteCollection(collection)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to delete collection")
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Data: map[string]string{
+			"collection": collection,
+			"message":    "Collection deleted successfully",
+		},
+	}
+
+	h.respondWithJSON(w, http.StatusOK, response)
+
+	log.Printf("%s | %d | %s | %s | %s | %s | %s",
+		time.Now().Format("15:04:05"),
+		http.StatusOK,
+		time.Since(start),
+		getClientIP(r),
+		r.Method,
+		r.URL.Path,
+		"-")
+}
+
+func (h *Handler) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	records, err := h.database.Backup()
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to create backup")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=backup.json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(records)
+	if err != nil {
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to encode backup")
+		return
+	}
+
+	log.Printf("%s | %d | %s | %s | %s | %s | %s",
+		time.Now().Format("15:04:05"),
+		http.StatusOK,
+		time.Since(start),
+		getClientIP(r),
+		r.Method,
+		r.URL.Path,
+		"-")
+}
+
+func (h *Handler) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.respondWithBodyError(w, err)
+		return
+	}
+
+	var records []db.Record
+	err = json.Unmarshal(body, &records)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid backup format")
+		return
+	}
+
+	err = h.database.Restore(records)
 	if err != nil {
-		h.respondWithError(w, http.StatusInternalServerError, "Failed to delete data")
+		h.respondWithError(w, http.StatusInternalServerError, "Failed to restore backup")
 		return
 	}
 
 	response := APIResponse{
 		Success: true,
-		Data: map[string]string{
-			"collection": collection,
-			"key":        key,
-			"message":    "Data deleted successfully",
+		Data: map[string]interface{}{
+			"message": "Backup restored successfully",
+			"records": len(records),
 		},
 	}
 
@@ -192,47 +1068,93 @@ func (h *Handler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		"-")
 }
 
-func (h *Handler) GetCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+// convertFormats are the formats ConvertHandler reads and writes, with the
+// content type of each.
+var convertFormats = map[string]string{
+	"toon":   "text/plain",
+	"json":   "application/json",
+	"yaml":   "application/yaml",
+	"ndjson": "application/x-ndjson",
+}
+
+// ConvertHandler converts the request body between TOON, JSON, YAML and
+// NDJSON. The from and to query parameters name the formats, JSON to TOON
+// by default, and the other parameters choose how TOON is written when it
+// is the target. Other formats are converted through TOON, so
+// from=yaml&to=json reads the YAML into TOON and writes that as JSON.
+func (h *Handler) ConvertHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
+	query := r.URL.Query()
 
-	collections, err := h.database.GetCollections()
+	from := query.Get("from")
+	if from == "" {
+		from = "json"
+	}
+	to := query.Get("to")
+	if to == "" {
+		to = "toon"
+	}
+	contentType, ok := convertFormats[to]
+	if _, known := convertFormats[from]; !known || !ok {
+		h.respondWithError(w, http.StatusBadRequest, "Unsupported conversion from "+from+" to "+to)
+		return
+	}
+
+	opts, err := encodeOptionsFromQuery(query)
 	if err != nil {
-		h.respondWithError(w, http.StatusInternalServerError, "Failed to get collections")
+		h.respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	// The TOON that is only passed on to another format is written in the
+	// standard layout, which is how it is read back
+	if to != "toon" {
+		opts = parser.EncodeOptions{}
+	}
 
-	h.respondWithJSON(w, http.StatusOK, collections)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.respondWithBodyError(w, err)
+		return
+	}
 
-	log.Printf("%s | %d | %s | %s | %s | %s | %s",
-		time.Now().Format("15:04:05"),
-		http.StatusOK,
-		time.Since(start),
-		getClientIP(r),
-		r.Method,
-		r.URL.Path,
-		"-")
-}
+	// Read the body into TOON
+	toon := string(body)
+	switch from {
+	case "json":
+		toon, err = h.parser.JSONToTOONWithOptions(toon, opts)
+	case "yaml":
+		toon, err = h.parser.YAMLToTOONWithOptions(toon, opts)
+	case "ndjson":
+		toon, err = h.parser.NDJSONToTOONWithOptions(toon, opts)
+	case "toon":
+		if to == "toon" {
+			toon, err = h.parser.Reformat(toon, opts)
+		}
+	}
 
-func (h *Handler) GetCollectionKeysHandler(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	vars := mux.Vars(r)
-	collection := vars["collection"]
+	// and write it in the format asked for
+	result := toon
+	if err == nil {
+		switch to {
+		case "json":
+			result, err = h.parser.ToonToJSONStrict(toon)
+		case "yaml":
+			result, err = h.parser.ToonToYAML(toon)
+		case "ndjson":
+			result, err = h.parser.ToonToNDJSON(toon)
+		}
+	}
 
-	keys, err := h.database.GetCollectionKeys(collection)
 	if err != nil {
-		h.respondWithError(w, http.StatusInternalServerError, "Failed to get collection keys")
+		if !h.respondWithParseError(w, err) {
+			h.respondWithError(w, http.StatusBadRequest, "Invalid "+strings.ToUpper(from)+": "+err.Error())
+		}
 		return
 	}
 
-	response := APIResponse{
-		Success: true,
-		Data: map[string]interface{}{
-			"collection": collection,
-			"keys":       keys,
-		},
-	}
-
-	h.respondWithJSON(w, http.StatusOK, response)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(result))
 
 	log.Printf("%s | %d | %s | %s | %s | %s | %s",
 		time.Now().Format("15:04:05"),
@@ -241,25 +1163,76 @@ func (h *Handler) GetCollectionKeysHandler(w http.ResponseWriter, r *http.Reques
 		getClientIP(r),
 		r.Method,
 		r.URL.Path,
-		"-")
+		from+"->"+to)
 }
 
-func (h *Handler) DeleteCollectionHandler(w http.ResponseWriter, r *http.Request) {
+// diffRequest is the body of a diff request. Each side is either a TOON
+// document as a string, or a stored record named by an object with
+// collection and key fields.
+type diffRequest struct {
+	Old json.RawMessage `json:"old"`
+	New json.RawMessage `json:"new"`
+}
+
+// DiffHandler compares two TOON documents and returns the path-level
+// changes that turn the old one into the new one.
+func (h *Handler) DiffHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	vars := mux.Vars(r)
-	collection := vars["collection"]
 
-	err := h.database.DeleteCollection(collection)
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		h.respondWithError(w, http.StatusInternalServerError, "Failed to delete collection")
+		h.respondWithBodyError(w, err)
 		return
 	}
 
+	var req diffRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	sides := map[string]json.RawMessage{"old": req.Old, "new": req.New}
+	docs := make(map[string]*parser.ToonData, len(sides))
+	for _, name := range []string{"old", "new"} {
+		doc, err := h.diffDocument(sides[name])
+
+		var parseErr *parser.ParseError
+		switch {
+		case errors.Is(err, db.ErrKeyNotFound):
+			h.respondWithError(w, http.StatusNotFound, "Key not found for the "+name+" document")
+			return
+		case errors.As(err, &parseErr):
+			h.respondWithJSON(w, http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   "Invalid TOON format in the " + name + " document",
+				Data: map[string]interface{}{
+					"diagnostics": reportedDiagnostics(parseErr.Diagnostics),
+				},
+			})
+			return
+		case err != nil:
+			h.respondWithError(w, http.StatusBadRequest, "Invalid "+name+" document: "+err.Error())
+			return
+		}
+		docs[name] = doc
+	}
+
+	changes := parser.Diff(docs["old"].Value, docs["new"].Value)
+	counts := map[parser.ChangeKind]int{}
+	for _, c := range changes {
+		counts[c.Kind]++
+	}
+	if changes == nil {
+		changes = []parser.Change{}
+	}
+
 	response := APIResponse{
 		Success: true,
-		Data: map[string]string{
-			"collection": collection,
-			"message":    "Collection deleted successfully",
+		Data: map[string]interface{}{
+			"changes":  changes,
+			"added":    counts[parser.ChangeAdded],
+			"removed":  counts[parser.ChangeRemoved],
+			"modified": counts[parser.ChangeModified],
 		},
 	}
 
@@ -272,66 +1245,223 @@ func (h *Handler) DeleteCollectionHandler(w http.ResponseWriter, r *http.Request
 		getClientIP(r),
 		r.Method,
 		r.URL.Path,
-		"-")
+		fmt.Sprintf("changes=%d", len(changes)))
 }
 
-func (h *Handler) BackupHandler(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
+// diffDocument reads one side of a diff request: a TOON document given as
+// a string, which is parsed strictly, or a stored record.
+func (h *Handler) diffDocument(raw json.RawMessage) (*parser.ToonData, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("missing")
+	}
 
-	records, err := h.database.Backup()
-	if err != nil {
-		h.respondWithError(w, http.StatusInternalServerError, "Failed to create backup")
-		return
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return h.parser.ParseToonWithOptions(text, parser.DecodeOptions{Strict: true})
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Content-Disposition", "attachment; filename=backup.json")
+	var record struct {
+		Collection string `json:"collection"`
+		Key        string `json:"key"`
+	}
+	if err := json.Unmarshal(raw, &record); err != nil || record.Collection == "" || record.Key == "" {
+		return nil, errors.New("expected a TOON string or an object with collection and key")
+	}
 
-	encoder := json.NewEncoder(w)
-	encoder.SetIndent("", "  ")
-	err = encoder.Encode(records)
+	data, err := h.database.Get(record.Collection, record.Key)
 	if err != nil {
-		h.respondWithError(w, http.StatusInternalServerError, "Failed to encode backup")
-		return
+		return nil, err
 	}
+	return h.parser.ParseToon(data)
+}
 
-	log.Printf("%s | %d | %s | %s | %s | %s | %s",
-		time.Now().Format("15:04:05"),
-		http.StatusOK,
-		time.Since(start),
-		getClientIP(r),
-		r.Method,
-		r.URL.Path,
-		"-")
+// recordRef names a stored record.
+type recordRef struct {
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
 }
 
-func (h *Handler) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+// contextRequest is the body of a context request. Records are taken from
+// records in the order given, then from query, and fields projects them.
+// A budget of zero means no limit.
+type contextRequest struct {
+	Records []recordRef   `json:"records"`
+	Query   *contextQuery `json:"query"`
+	Fields  []string      `json:"fields"`
+	Budget  int           `json:"budget"`
+}
+
+// contextQuery selects the records of a collection, in the order of their
+// keys, whose documents meet every condition in where, as in ?where= on
+// rows. A limit of zero means no limit.
+type contextQuery struct {
+	Collection string   `json:"collection"`
+	Where      []string `json:"where"`
+	Limit      int      `json:"limit"`
+}
+
+// ContextHandler assembles records into a single TOON document for a
+// prompt, folding records of the same shape into tables. If the document
+// takes more tokens than the budget, the records at the end are dropped
+// until it fits, and reported.
+func (h *Handler) ContextHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "Failed to read request body")
+		h.respondWithBodyError(w, err)
 		return
 	}
 
-	var records []db.Record
-	err = json.Unmarshal(body, &records)
+	var req contextRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	if len(req.Records) == 0 && req.Query == nil {
+		h.respondWithError(w, http.StatusBadRequest, "Expected records or a query")
+		return
+	}
+	if req.Budget < 0 || req.Query != nil && req.Query.Limit < 0 {
+		h.respondWithError(w, http.StatusBadRequest, "Invalid budget or limit, expected a non-negative number")
+		return
+	}
+
+	opts, err := encodeOptionsFromQuery(r.URL.Query())
 	if err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "Invalid backup format")
+		h.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	builder, err := h.parser.NewContextBuilder(req.Fields)
+	if err != nil {
+		h.respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	err = h.database.Restore(records)
+	// Add the records, each once, noting those that do not exist
+	added := []recordRef{}
+	missing := []recordRef{}
+	seen := make(map[recordRef]bool)
+	add := func(ref recordRef, data string) error {
+		seen[ref] = true
+		if err := builder.Add(ref.Collection, ref.Key, data); err != nil {
+			return err
+		}
+		added = append(added, ref)
+		return nil
+	}
+
+	for _, ref := range req.Records {
+		if ref.Collection == "" || ref.Key == "" {
+			h.respondWithError(w, http.StatusBadRequest, "Each record needs a collection and a key")
+			return
+		}
+		if seen[ref] {
+			continue
+		}
+		data, err := h.database.Get(ref.Collection, ref.Key)
+		if errors.Is(err, db.ErrKeyNotFound) {
+			missing = append(missing, ref)
+			continue
+		}
+		if err == nil {
+			err = add(ref, data)
+		}
+		if err != nil {
+			h.respondWithError(w, http.StatusInternalServerError, "Failed to read "+ref.Collection+"/"+ref.Key)
+			return
+		}
+	}
+
+	if q := req.Query; q != nil {
+		if q.Collection == "" {
+			h.respondWithError(w, http.StatusBadRequest, "The query needs a collection")
+			return
+		}
+		var conditions []parser.Condition
+		for _, expr := range q.Where {
+			c, err := parser.ParseCondition(expr)
+			if err != nil {
+				h.respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			conditions = append(conditions, c)
+		}
+
+		keys, err := h.database.GetCollectionKeys(q.Collection)
+		if err != nil {
+			h.respondWithError(w, http.StatusInternalServerError, "Failed to get collection keys")
+			return
+		}
+		matched := 0
+		for _, key := range keys {
+			if q.Limit > 0 && matched == q.Limit {
+				break
+			}
+			ref := recordRef{Collection: q.Collection, Key: key}
+			if seen[ref] {
+				continue
+			}
+			data, err := h.database.Get(ref.Collection, ref.Key)
+			if errors.Is(err, db.ErrKeyNotFound) {
+				// Deleted since the keys were listed
+				continue
+			}
+			if err == nil && len(conditions) > 0 {
+				var doc *parser.ToonData
+				if doc, err = h.parser.ParseToon(data); err == nil {
+					row, ok := doc.Value.(map[string]interface{})
+					if !ok || !matchAll(conditions, row) {
+						continue
+					}
+				}
+			}
+			if err == nil {
+				err = add(ref, data)
+			}
+			if err != nil {
+				h.respondWithError(w, http.StatusInternalServerError, "Failed to read "+ref.Collection+"/"+ref.Key)
+				return
+			}
+			matched++
+		}
+	}
+
+	// Keep as many records as fit in the budget, in order
+	included := builder.Len()
+	document, err := builder.Document(included, opts)
 	if err != nil {
-		h.respondWithError(w, http.StatusInternalServerError, "Failed to restore backup")
+		h.respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	tokens := h.tokenizer.Count(document)
+	if req.Budget > 0 && tokens > req.Budget {
+		// No records take no tokens, and more records never take fewer
+		lo, hi := 0, included-1
+		for lo < hi {
+			mid := (lo + hi + 1) / 2
+			doc, _ := builder.Document(mid, opts)
+			if h.tokenizer.Count(doc) <= req.Budget {
+				lo = mid
+			} else {
+				hi = mid - 1
+			}
+		}
+		included = lo
+		document, _ = builder.Document(included, opts)
+		tokens = h.tokenizer.Count(document)
+	}
 
 	response := APIResponse{
 		Success: true,
 		Data: map[string]interface{}{
-			"message": "Backup restored successfully",
-			"records": len(records),
+			"context":   document,
+			"tokens":    tokens,
+			"budget":    req.Budget,
+			"tokenizer": h.tokenizer.Name(),
+			"records":   added[:included],
+			"dropped":   added[included:],
+			"missing":   missing,
 		},
 	}
 
@@ -344,7 +1474,7 @@ func (h *Handler) RestoreHandler(w http.ResponseWriter, r *http.Request) {
 		getClientIP(r),
 		r.Method,
 		r.URL.Path,
-		"-")
+		fmt.Sprintf("records=%d dropped=%d tokens=%d", included, len(added)-included, tokens))
 }
 
 func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
@@ -482,6 +1612,10 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
                     </button>
                 </div>
 
+                <button onclick="showCompare()" class="w-full lg:hidden bg-white border border-gray-200 text-gray-600 hover:text-indigo-600 py-2 rounded-lg text-xs font-bold">
+                    <i class="fas fa-code-compare"></i> مقایسه
+                </button>
+
                 <button onclick="logout()" class="w-full flex items-center justify-center gap-2 text-red-500 bg-red-50 hover:bg-red-100 py-2.5 rounded-xl font-bold text-xs transition-colors">
                     <i class="fas fa-power-off"></i> خروج
                 </button>
@@ -509,6 +1643,9 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
                     <button onclick="$('restoreFile').click()" class="px-3 py-2 text-gray-600 hover:bg-gray-100 hover:text-emerald-600 rounded-lg text-sm font-bold transition-colors" title="بازگردانی دیتابیس">
                         <i class="fas fa-upload ml-1"></i> بازیابی
                     </button>
+                    <button onclick="showCompare()" class="px-3 py-2 text-gray-600 hover:bg-gray-100 hover:text-amber-600 rounded-lg text-sm font-bold transition-colors" title="مقایسه دو سند">
+                        <i class="fas fa-code-compare ml-1"></i> مقایسه
+                    </button>
                     
                     <div class="h-6 w-px bg-gray-200 mx-1"></div>
                     
@@ -543,6 +1680,29 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
                             <h3 class="text-lg font-bold">آنلاین و فعال</h3>
                         </div>
                     </div>
+
+                    <!-- Token counts per collection -->
+                    <div id="tokenStats" class="hidden bg-white rounded-2xl shadow-sm border border-gray-100 mb-6 overflow-hidden">
+                        <div class="flex items-center justify-between px-5 py-4 border-b border-gray-100">
+                            <h3 class="font-bold text-gray-800 text-sm"><i class="fas fa-coins text-amber-500 ml-2"></i>توکن‌ها به تفکیک کالکشن</h3>
+                            <span id="tokenizerName" class="text-[10px] px-2 py-0.5 rounded-lg font-mono bg-gray-50 text-gray-500 border border-gray-100"></span>
+                        </div>
+                        <div class="overflow-x-auto">
+                            <table class="w-full text-sm">
+                                <thead class="bg-gray-50 text-gray-500 text-xs">
+                                    <tr>
+                                        <th class="text-right font-bold px-5 py-2">کالکشن</th>
+                                        <th class="text-right font-bold px-3 py-2">رکورد</th>
+                                        <th class="text-right font-bold px-3 py-2">TOON</th>
+                                        <th class="text-right font-bold px-3 py-2">JSON</th>
+                                        <th class="text-right font-bold px-3 py-2">JSON مرتب</th>
+                                        <th class="text-right font-bold px-5 py-2">صرفه‌جویی (JSON / مرتب)</th>
+                                    </tr>
+                                </thead>
+                                <tbody id="tokenRows" class="divide-y divide-gray-50 font-mono"></tbody>
+                            </table>
+                        </div>
+                    </div>
                     
                     <div class="text-center py-16 px-4">
                         <div class="inline-block p-6 bg-white rounded-full shadow-sm mb-4">
@@ -585,6 +1745,32 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
                         <p class="text-sm font-medium">داده‌ای یافت نشد</p>
                     </div>
                 </div>
+
+                <!-- Compare View -->
+                <div id="compareView" class="hidden max-w-6xl mx-auto pb-20">
+                    <div class="grid grid-cols-1 md:grid-cols-2 gap-4 mb-4">
+                        <div>
+                            <div class="flex justify-between items-center mb-2 px-1 gap-2">
+                                <label class="text-xs font-bold text-red-500 whitespace-nowrap">نسخه قدیم</label>
+                                <select id="compareOldRecord" onchange="loadCompareSide('Old')" class="flex-1 max-w-[60%] bg-white border border-gray-200 rounded-lg px-2 py-1.5 text-xs font-mono dir-ltr"></select>
+                            </div>
+                            <textarea id="compareOldData" class="w-full h-64 p-4 bg-[#1e293b] text-gray-100 font-mono text-sm leading-relaxed outline-none resize-none dir-ltr rounded-xl border border-gray-300" placeholder="// Old TOON document..."></textarea>
+                        </div>
+                        <div>
+                            <div class="flex justify-between items-center mb-2 px-1 gap-2">
+                                <label class="text-xs font-bold text-emerald-600 whitespace-nowrap">نسخه جدید</label>
+                                <select id="compareNewRecord" onchange="loadCompareSide('New')" class="flex-1 max-w-[60%] bg-white border border-gray-200 rounded-lg px-2 py-1.5 text-xs font-mono dir-ltr"></select>
+                            </div>
+                            <textarea id="compareNewData" class="w-full h-64 p-4 bg-[#1e293b] text-gray-100 font-mono text-sm leading-relaxed outline-none resize-none dir-ltr rounded-xl border border-gray-300" placeholder="// New TOON document..."></textarea>
+                        </div>
+                    </div>
+
+                    <button onclick="runCompare()" class="w-full md:w-auto bg-indigo-600 hover:bg-indigo-700 text-white px-6 py-2.5 rounded-xl text-sm font-bold shadow-lg shadow-indigo-200 transition-transform active:scale-95 mb-4">
+                        <i class="fas fa-code-compare ml-1"></i> مقایسه
+                    </button>
+
+                    <div id="compareResult" class="space-y-2"></div>
+                </div>
             </div>
         </main>
     </div>
@@ -645,7 +1831,8 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
             activeCol: null,
             cache: {},
             start: Date.now(),
-            lastChecksum: ''
+            lastChecksum: '',
+            comparing: false
         };
 
         const $ = id => document.getElementById(id);
@@ -756,7 +1943,7 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
                 if (!isSearching || forceRender) {
                     renderView(store.activeCol);
                 }
-            } else if (!store.activeCol) {
+            } else if (!store.activeCol && !store.comparing) {
                 showDash();
             }
         }
@@ -789,7 +1976,8 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
 
         function selectCol(col) {
             toggleSidebar(false);
-            if(store.activeCol !== col) {
+            if(store.activeCol !== col || store.comparing) {
+                store.comparing = false;
                 store.activeCol = col;
                 $('searchKey').value = ''; // Reset filter
                 updateUI(true);
@@ -799,6 +1987,7 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
         function renderView(col) {
             store.activeCol = col;
             $('dashboardView').classList.add('hidden');
+            $('compareView').classList.add('hidden');
             $('tableView').classList.remove('hidden');
             $('pageTitle').innerHTML = '<span class="text-indigo-600 font-mono text-lg mr-2">/ ' + col + '</span>';
             $('recordCountBadge').textContent = store.cols[col].length + ' رکورد';
@@ -839,6 +2028,7 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
                             '<div class="font-mono text-sm font-bold text-gray-800 break-all dir-ltr text-left bg-gray-50 px-2 py-1 rounded border border-gray-100">' + key + '</div>' +
                             '<div class="flex gap-1 opacity-100 md:opacity-0 group-hover:opacity-100 transition-opacity">' +
                                 '<button onclick="edit(\'' + col + '\',\'' + key + '\')" class="w-8 h-8 rounded-lg bg-indigo-50 text-indigo-600 hover:bg-indigo-600 hover:text-white transition-colors"><i class="fas fa-pen text-xs"></i></button>' +
+                                '<button onclick="compareWith(\'' + col + '\',\'' + key + '\')" class="w-8 h-8 rounded-lg bg-amber-50 text-amber-600 hover:bg-amber-500 hover:text-white transition-colors" title="مقایسه"><i class="fas fa-code-compare text-xs"></i></button>' +
                                 '<button onclick="del(\'' + col + '\',\'' + key + '\')" class="w-8 h-8 rounded-lg bg-red-50 text-red-500 hover:bg-red-500 hover:text-white transition-colors"><i class="fas fa-trash text-xs"></i></button>' +
                             '</div>' +
                         '</div>' +
@@ -923,11 +2113,106 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
             reader.readAsText(file);
         }
 
+        // --- Compare ---
+        function showCompare() {
+            toggleSidebar(false);
+            store.activeCol = null;
+            store.comparing = true;
+            $('dashboardView').classList.add('hidden');
+            $('tableView').classList.add('hidden');
+            $('compareView').classList.remove('hidden');
+            $('pageTitle').innerHTML = '<i class="fas fa-code-compare text-amber-500"></i> مقایسه';
+            renderSidebar();
+
+            let options = '<option value="">متن دلخواه</option>';
+            Object.keys(store.cols).sort().forEach(col => {
+                store.cols[col].slice().sort().forEach(key => {
+                    const id = esc(col + '/' + key);
+                    options += '<option value="' + id + '">' + id + '</option>';
+                });
+            });
+            ['Old', 'New'].forEach(side => {
+                const sel = $('compare' + side + 'Record');
+                const current = sel.value;
+                sel.innerHTML = options;
+                sel.value = current;
+            });
+        }
+
+        function compareWith(col, key) {
+            showCompare();
+            $('compareOldRecord').value = col + '/' + key;
+            loadCompareSide('Old');
+        }
+
+        function loadCompareSide(side) {
+            const id = $('compare' + side + 'Record').value;
+            if (!id) return;
+            const i = id.indexOf('/');
+            req('/api/' + id.slice(0, i) + '/' + id.slice(i + 1)).then(r => r.text()).then(t => {
+                $('compare' + side + 'Data').value = t;
+            }).catch(() => toast('خطا در بارگذاری رکورد', 'err'));
+        }
+
+        function runCompare() {
+            const body = JSON.stringify({ old: $('compareOldData').value, new: $('compareNewData').value });
+            req('/api/diff', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: body })
+                .then(r => r.json())
+                .then(res => {
+                    if (!res.success) {
+                        const diags = (res.data && res.data.diagnostics) || [];
+                        toast(diags.length ? res.error + ': ' + diags.map(d => 'L' + d.line + ' ' + d.message).join(' | ') : res.error, 'err');
+                        return;
+                    }
+                    renderChanges(res.data);
+                })
+                .catch(() => toast('خطا در ارتباط با سرور', 'err'));
+        }
+
+        function renderChanges(d) {
+            const styles = {
+                added: ['bg-emerald-50 border-emerald-100', 'bg-emerald-500', 'fa-plus'],
+                removed: ['bg-red-50 border-red-100', 'bg-red-500', 'fa-minus'],
+                modified: ['bg-amber-50 border-amber-100', 'bg-amber-500', 'fa-pen']
+            };
+            const show = v => v === undefined ? '' : esc(JSON.stringify(v));
+
+            let html = '<div class="flex gap-2 text-xs font-bold mb-3">' +
+                '<span class="bg-emerald-100 text-emerald-700 px-3 py-1.5 rounded-lg">+' + d.added + '</span>' +
+                '<span class="bg-red-100 text-red-700 px-3 py-1.5 rounded-lg">-' + d.removed + '</span>' +
+                '<span class="bg-amber-100 text-amber-700 px-3 py-1.5 rounded-lg">~' + d.modified + '</span>' +
+            '</div>';
+
+            if (d.changes.length === 0) {
+                html += '<div class="text-center py-10 text-gray-400 text-sm"><i class="fas fa-equals text-3xl mb-3 block text-gray-300"></i>دو سند یکسان هستند</div>';
+            }
+
+            d.changes.forEach(c => {
+                const [box, badge, icon] = styles[c.kind];
+                html += '<div class="' + box + ' border rounded-xl p-3 dir-ltr text-left font-mono text-xs flex items-start gap-3">' +
+                    '<span class="' + badge + ' text-white w-6 h-6 rounded-md flex items-center justify-center shrink-0"><i class="fas ' + icon + ' text-[10px]"></i></span>' +
+                    '<div class="min-w-0 flex-1">' +
+                        '<div class="font-bold text-gray-800 break-all">' + (esc(c.path) || '(document)') + '</div>' +
+                        (c.kind !== 'added' ? '<div class="text-red-600 break-all">- ' + show(c.old) + '</div>' : '') +
+                        (c.kind !== 'removed' ? '<div class="text-emerald-700 break-all">+ ' + show(c.new) + '</div>' : '') +
+                    '</div>' +
+                '</div>';
+            });
+
+            $('compareResult').innerHTML = html;
+        }
+
+        function esc(s) {
+            return String(s).replace(/[&<>"']/g, c => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' })[c]);
+        }
+
         // --- Utils & Actions ---
         function showDash() {
             store.activeCol = null;
+            store.comparing = false;
             $('dashboardView').classList.remove('hidden');
             $('tableView').classList.add('hidden');
+            $('compareView').classList.add('hidden');
             $('pageTitle').innerHTML = '<i class="fas fa-home text-gray-400"></i> داشبورد';
         }
 
@@ -936,6 +2221,32 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
             $('dashTotalCollections').textContent = Object.keys(store.cols).length;
             $('dashTotalKeys').textContent = total;
             $('dbSize').textContent = Math.round(total * 0.1) + ' KB';
+            loadTokenStats();
+        }
+
+        // Token totals are counted over every document, so they are only
+        // fetched when the collections change, not on every poll
+        function loadTokenStats() {
+            req('/api/tokens').then(r => r.json()).then(d => {
+                const cols = (d.data && d.data.collections) || {};
+                const names = Object.keys(cols).sort();
+                $('tokenStats').classList.toggle('hidden', names.length === 0);
+                $('tokenizerName').textContent = d.data ? d.data.tokenizer : '';
+
+                const saved = (toon, other) => other ? Math.round(100 * (other - toon) / other) : 0;
+                $('tokenRows').innerHTML = names.map(name => {
+                    const c = cols[name];
+                    return '<tr class="hover:bg-gray-50 cursor-pointer" onclick="selectCol(\'' + name + '\')">' +
+                        '<td class="px-5 py-2 font-bold text-gray-800">' + esc(name) + '</td>' +
+                        '<td class="px-3 py-2 text-gray-500">' + c.records + '</td>' +
+                        '<td class="px-3 py-2 text-indigo-600 font-bold">' + c.toon.toLocaleString() + '</td>' +
+                        '<td class="px-3 py-2 text-gray-500">' + c.json.toLocaleString() + '</td>' +
+                        '<td class="px-3 py-2 text-gray-500">' + c.json_pretty.toLocaleString() + '</td>' +
+                        '<td class="px-5 py-2"><span class="bg-emerald-50 text-emerald-600 text-xs px-2 py-0.5 rounded-lg font-bold">' +
+                            saved(c.toon, c.json) + '% / ' + saved(c.toon, c.json_pretty) + '%</span></td>' +
+                    '</tr>';
+                }).join('');
+            }).catch(()=>{});
         }
 
         function copyValue(el) {
@@ -1000,7 +2311,10 @@ func (h *Handler) WebHandler(w http.ResponseWriter, r *http.Request) {
                     toast('ذخیره شد');
                     closeModal();
                     refresh(true);
-                } else toast(res.error, 'err');
+                } else {
+                    const diags = (res.data && res.data.diagnostics) || [];
+                    toast(diags.length ? res.error + ': ' + diags.map(d => 'L' + d.line + ' ' + d.message).join(' | ') : res.error, 'err');
+                }
             });
         }
 
@@ -1083,6 +2397,79 @@ func (h *Handler) respondWithError(w http.ResponseWriter, code int, message stri
 	})
 }
 
+// maxReportedDiagnostics is the most diagnostics sent back for a document.
+const maxReportedDiagnostics = 100
+
+// reportedDiagnostics returns at most maxReportedDiagnostics of diags,
+// keeping the last, which tells why reading stopped if it did.
+func reportedDiagnostics(diags []parser.Diagnostic) []parser.Diagnostic {
+	if len(diags) <= maxReportedDiagnostics {
+		return diags
+	}
+	n := maxReportedDiagnostics - 1
+	return append(diags[:n:n], diags[len(diags)-1])
+}
+
+// respondWithParseError reports a malformed TOON document along with its
+// diagnostics. It returns false, writing nothing, if err is not a
+// *parser.ParseError.
+func (h *Handler) respondWithParseError(w http.ResponseWriter, err error) bool {
+	var parseErr *parser.ParseError
+	if !errors.As(err, &parseErr) {
+		return false
+	}
+
+	message := "Invalid TOON format"
+	if n := len(parseErr.Diagnostics); n > 0 && parseErr.Diagnostics[n-1].Reason == parser.ReasonLimitExceeded {
+		// Reading stopped at the limit, which is the last problem found
+		message = "TOON document exceeds a limit: " + parseErr.Diagnostics[n-1].Message
+	}
+
+	h.respondWithJSON(w, http.StatusBadRequest, APIResponse{
+		Success: false,
+		Error:   message,
+		Data: map[string]interface{}{
+			"diagnostics": reportedDiagnostics(parseErr.Diagnostics),
+		},
+	})
+	return true
+}
+
+// respondWithLimitError reports an edit rejected by checkLimits with 413 and
+// the diagnostic of the limit exceeded. It returns false, without writing a
+// response, if err is not a limitError.
+func (h *Handler) respondWithLimitError(w http.ResponseWriter, err error) bool {
+	var limitErr limitError
+	if !errors.As(err, &limitErr) {
+		return false
+	}
+
+	h.respondWithJSON(w, http.StatusRequestEntityTooLarge, APIResponse{
+		Success: false,
+		Error:   "Edited document exceeds a limit: " + limitErr.Error(),
+		Data: map[string]interface{}{
+			"diagnostics": []parser.Diagnostic{limitErr.diag},
+		},
+	})
+	return true
+}
+
+// respondWithBodyError reports a request body that could not be read, with
+// 413 if it was over the cap set by SetBodyLimit, or that is invalid.
+func (h *Handler) respondWithBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	var reqErr requestError
+	if errors.As(err, &reqErr) {
+		h.respondWithError(w, http.StatusBadRequest, reqErr.Error())
+		return
+	}
+	if errors.As(err, &tooLarge) {
+		h.respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds the limit of %d bytes", tooLarge.Limit))
+		return
+	}
+	h.respondWithError(w, http.StatusBadRequest, "Failed to read request body")
+}
+
 func (h *Handler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -1098,3 +2485,64 @@ func getClientIP(r *http.Request) string {
 	}
 	return "127.0.0.1"
 }
+
+// isJSONContentType reports whether a Content-Type header names JSON, such
+// as application/json or application/merge-patch+json.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// encodeOptionsFromQuery reads the TOON encoder options given as query
+// parameters: indent, length_marker, delimiter, sort_keys, fold_keys,
+// tabular_threshold and max_width.
+func encodeOptionsFromQuery(query url.Values) (parser.EncodeOptions, error) {
+	var opts parser.EncodeOptions
+
+	if name := query.Get("delimiter"); name != "" {
+		delim, ok := delimiters[name]
+		if !ok {
+			return opts, fmt.Errorf("Invalid delimiter, expected comma, tab or pipe")
+		}
+		opts.Delimiter = delim
+	}
+
+	ints := map[string]struct {
+		dst *int
+		max int
+	}{
+		"indent":            {&opts.Indent, parser.MaxIndent},
+		"tabular_threshold": {&opts.TabularThreshold, math.MaxInt},
+		"max_width":         {&opts.MaxLineWidth, parser.MaxLineWidth},
+	}
+	for name, option := range ints {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("Invalid %s, expected a non-negative number", name)
+			}
+			if n > option.max {
+				return opts, fmt.Errorf("Invalid %s, expected at most %d", name, option.max)
+			}
+			*option.dst = n
+		}
+	}
+
+	bools := map[string]*bool{
+		"length_marker": &opts.LengthMarker,
+		"sort_keys":     &opts.SortKeys,
+		"fold_keys":     &opts.FoldKeys,
+	}
+	for name, dst := range bools {
+		if value := query.Get(name); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("Invalid %s, expected true or false", name)
+			}
+			*dst = b
+		}
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,167 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// flatDocument has a single level of fields of every scalar type.
+func flatDocument() string {
+	var b strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&b, "name_%d: user number %d\n", i, i)
+		fmt.Fprintf(&b, "count_%d: %d\n", i, i*37)
+		fmt.Fprintf(&b, "ratio_%d: %d.25\n", i, i)
+		fmt.Fprintf(&b, "active_%d: %t\n", i, i%2 == 0)
+		fmt.Fprintf(&b, "note_%d: \"quoted, with \\\"escapes\\\"\"\n", i)
+	}
+	return b.String()
+}
+
+// nestedDocument has objects nested several levels deep, with inline arrays
+// and lists of objects along the way.
+func nestedDocument() string {
+	var b strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&b, "account_%d:\n", i)
+		fmt.Fprintf(&b, "  id: %d\n", i)
+		b.WriteString("  profile:\n")
+		b.WriteString("    name: Ali Rezaei\n")
+		b.WriteString("    address:\n")
+		b.WriteString("      city: Tehran\n")
+		b.WriteString("      zip: \"01234\"\n")
+		b.WriteString("      geo:\n")
+		b.WriteString("        lat: 35.6892\n")
+		b.WriteString("        lng: 51.389\n")
+		b.WriteString("    tags[3]: admin,editor,viewer\n")
+		b.WriteString("  orders[2]:\n")
+		b.WriteString("    - id: 1\n")
+		b.WriteString("      total: 99.5\n")
+		b.WriteString("      items[2]: book,pen\n")
+		b.WriteString("    - id: 2\n")
+		b.WriteString("      total: 12\n")
+		b.WriteString("      items[1]: lamp\n")
+	}
+	return b.String()
+}
+
+// tabularDocument has a single table of 10,000 rows.
+func tabularDocument() string {
+	const rows = 10000
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "users[%d]{id,name,email,age,score,active}:\n", rows)
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&b, "  %d,User %d,user%d@example.com,%d,%d.5,%t\n", i, i, i, 20+i%50, i%100, i%3 == 0)
+	}
+	return b.String()
+}
+
+func benchmarkParse(b *testing.B, doc string) {
+	p := NewParser()
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := p.ParseToonWithOptions(doc, DecodeOptions{Strict: true}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkValidate(b *testing.B, doc string) {
+	p := NewParser()
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := p.Validate(strings.NewReader(doc)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseFlat(b *testing.B) {
+	benchmarkParse(b, flatDocument())
+}
+
+func BenchmarkParseNested(b *testing.B) {
+	benchmarkParse(b, nestedDocument())
+}
+
+func BenchmarkParseTabular(b *testing.B) {
+	benchmarkParse(b, tabularDocument())
+}
+
+func BenchmarkValidateFlat(b *testing.B) {
+	benchmarkValidate(b, flatDocument())
+}
+
+func BenchmarkValidateNested(b *testing.B) {
+	benchmarkValidate(b, nestedDocument())
+}
+
+func BenchmarkValidateTabular(b *testing.B) {
+	benchmarkValidate(b, tabularDocument())
+}
+
+// BenchmarkDecodeTabularRows streams the 10,000-row table into structs one
+// row at a time.
+func BenchmarkDecodeTabularRows(b *testing.B) {
+	type user struct {
+		ID     int     `toon:"id"`
+		Name   string  `toon:"name"`
+		Email  string  `toon:"email"`
+		Age    int     `toon:"age"`
+		Score  float64 `toon:"score"`
+		Active bool    `toon:"active"`
+	}
+
+	doc := tabularDocument()
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		dec := NewDecoder(strings.NewReader(doc))
+		dec.Strict()
+		for _, want := range []Token{Delim('{'), "users", Delim('[')} {
+			if tok, err := dec.Token(); err != nil || tok != want {
+				b.Fatalf("got token %v, %v, want %v", tok, err, want)
+			}
+		}
+		for dec.More() {
+			var u user
+			if err := dec.Decode(&u); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for {
+			if _, err := dec.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeTabular(b *testing.B) {
+	p := NewParser()
+	data, err := p.ParseToon(tabularDocument())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(data.Value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package parser
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The conformance suite runs the fixtures in testdata/conformance, laid out
+// like the test cases of the TOON specification. Each file holds a group of
+// tests of one category, decode or encode. A decode test reads the TOON
+// document in input and expects the JSON value in expected, or with
+// shouldError a *ParseError, whose diagnostics have the reasons in errors
+// if it is given. An encode test writes the JSON value in input and expects
+// the TOON document in expected.
+//
+// Every test that succeeds is also read back the other way, so a decode
+// test checks that its expected value survives JSONToTOON and ParseToon,
+// and an encode test that its input does.
+//
+// The conversions between TOON and other formats have a category for each
+// direction, such as from-yaml and to-yaml, whose tests convert the
+// document in input to the one in expected, both as strings. With
+// shouldError, expected is part of the error message instead. These are
+// also converted back, which must give the TOON document again, in the
+// standard layout, with its keys in the same order.
+
+type fixtureFile struct {
+	Category    string        `json:"category"`
+	Description string        `json:"description"`
+	Tests       []fixtureTest `json:"tests"`
+}
+
+type fixtureTest struct {
+	Name        string          `json:"name"`
+	Input       json.RawMessage `json:"input"`
+	Expected    json.RawMessage `json:"expected"`
+	Options     fixtureOptions  `json:"options"`
+	ShouldError bool            `json:"shouldError"`
+	Errors      []Reason        `json:"errors"`
+	SpecSection string          `json:"specSection"`
+}
+
+// fixtureOptions are the options of a test, named as in the specification.
+// Decode tests are strict unless strict is false.
+type fixtureOptions struct {
+	Strict      *bool  `json:"strict"`
+	Indent      int    `json:"indent"`
+	ExpandPaths string `json:"expandPaths"`
+
+	Delimiter        string `json:"delimiter"`
+	LengthMarker     string `json:"lengthMarker"`
+	KeyFolding       string `json:"keyFolding"`
+	SortKeys         bool   `json:"sortKeys"`
+	TabularThreshold int    `json:"tabularThreshold"`
+	MaxLineWidth     int    `json:"maxLineWidth"`
+}
+
+func (o fixtureOptions) decode() DecodeOptions {
+	return DecodeOptions{
+		Strict:      o.Strict == nil || *o.Strict,
+		Indent:      o.Indent,
+		ExpandPaths: o.ExpandPaths == "safe",
+	}
+}
+
+func (o fixtureOptions) encode() EncodeOptions {
+	opts := EncodeOptions{
+		Indent:           o.Indent,
+		LengthMarker:     o.LengthMarker == "#",
+		FoldKeys:         o.KeyFolding == "safe",
+		SortKeys:         o.SortKeys,
+		TabularThreshold: o.TabularThreshold,
+		MaxLineWidth:     o.MaxLineWidth,
+	}
+	if o.Delimiter != "" {
+		opts.Delimiter = o.Delimiter[0]
+	}
+	return opts
+}
+
+// readback returns the options that read a document written with o.
+func (o fixtureOptions) readback() DecodeOptions {
+	return DecodeOptions{
+		Strict:      true,
+		Indent:      o.Indent,
+		ExpandPaths: o.KeyFolding == "safe" || o.ExpandPaths == "safe",
+	}
+}
+
+func loadFixtures(t testing.TB, category string) map[string]fixtureFile {
+	paths, err := filepath.Glob(filepath.Join("testdata", "conformance", category, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no %s fixtures found", category)
+	}
+
+	files := make(map[string]fixtureFile, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var file fixtureFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if file.Category != category {
+			t.Fatalf("%s: category is %q, want %q", path, file.Category, category)
+		}
+		files[strings.TrimSuffix(filepath.Base(path), ".json")] = file
+	}
+	return files
+}
+
+func TestConformanceDecode(t *testing.T) {
+	p := NewParser()
+	for name, file := range loadFixtures(t, "decode") {
+		for _, tc := range file.Tests {
+			tc := tc
+			t.Run(name+"/"+tc.Name, func(t *testing.T) {
+				var input string
+				if err := json.Unmarshal(tc.Input, &input); err != nil {
+					t.Fatalf("input must be a TOON document as a string: %v", err)
+				}
+
+				data, err := p.ParseToonWithOptions(input, tc.Options.decode())
+				if tc.ShouldError {
+					checkParseError(t, err, tc.Errors)
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				want := decodeFixtureJSON(t, tc.Expected)
+				if !sameJSON(data.Value, want, false) {
+					t.Fatalf("decoded %s, want %s", mustJSON(data.Value), tc.Expected)
+				}
+
+				// ToonToJSON has no options, but keeps the order of keys
+				if tc.Options.Indent == 0 && tc.Options.ExpandPaths != "safe" {
+					out, err := p.ToonToJSON(input)
+					if err != nil {
+						t.Fatalf("ToonToJSON: %v", err)
+					}
+					if got := decodeFixtureJSON(t, json.RawMessage(out)); !sameJSON(got, want, true) {
+						t.Fatalf("ToonToJSON gave %s, want %s", out, tc.Expected)
+					}
+				}
+
+				checkRoundTrip(t, p, want, fixtureOptions{})
+			})
+		}
+	}
+}
+
+func TestConformanceEncode(t *testing.T) {
+	p := NewParser()
+	for name, file := range loadFixtures(t, "encode") {
+		for _, tc := range file.Tests {
+			tc := tc
+			t.Run(name+"/"+tc.Name, func(t *testing.T) {
+				got, err := p.JSONToTOONWithOptions(string(tc.Input), tc.Options.encode())
+				if tc.ShouldError {
+					if err == nil {
+						t.Fatalf("expected an error, got\n%s", got)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				var want string
+				if err := json.Unmarshal(tc.Expected, &want); err != nil {
+					t.Fatalf("expected must be a TOON document as a string: %v", err)
+				}
+				if got != want {
+					t.Fatalf("encoded\n%s\nwant\n%s", got, want)
+				}
+
+				checkRoundTrip(t, p, decodeFixtureJSON(t, tc.Input), tc.Options)
+			})
+		}
+	}
+}
+
+// conversion is a format TOON converts from and to, with the encoder
+// options applying only to the TOON it writes.
+type conversion struct {
+	toTOON   func(p *Parser, doc string, opts EncodeOptions) (string, error)
+	fromTOON func(p *Parser, toon string) (string, error)
+}
+
+var conversions = map[string]conversion{
+	"yaml":   {(*Parser).YAMLToTOONWithOptions, (*Parser).ToonToYAML},
+	"ndjson": {(*Parser).NDJSONToTOONWithOptions, (*Parser).ToonToNDJSON},
+}
+
+func TestConformanceConvert(t *testing.T) {
+	p := NewParser()
+	for format, c := range conversions {
+		c := c
+		for name, file := range loadFixtures(t, "from-"+format) {
+			for _, tc := range file.Tests {
+				tc := tc
+				t.Run("from-"+format+"/"+name+"/"+tc.Name, func(t *testing.T) {
+					input, want := fixtureDocuments(t, tc)
+					got, err := c.toTOON(p, input, tc.Options.encode())
+					if !checkConversion(t, got, err, want, tc.ShouldError) {
+						return
+					}
+
+					toon, err := c.toTOON(p, input, EncodeOptions{})
+					if err != nil {
+						t.Fatalf("converting with the default options: %v", err)
+					}
+					back, err := c.fromTOON(p, toon)
+					if err != nil {
+						t.Fatalf("converting back\n%s: %v", toon, err)
+					}
+					if again, err := c.toTOON(p, back, EncodeOptions{}); err != nil || again != toon {
+						t.Fatalf("converting back gave\n%s\nwhich converts to\n%s%v", back, again, err)
+					}
+				})
+			}
+		}
+
+		for name, file := range loadFixtures(t, "to-"+format) {
+			for _, tc := range file.Tests {
+				tc := tc
+				t.Run("to-"+format+"/"+name+"/"+tc.Name, func(t *testing.T) {
+					input, want := fixtureDocuments(t, tc)
+					got, err := c.fromTOON(p, input)
+					if !checkConversion(t, got, err, want, tc.ShouldError) {
+						return
+					}
+
+					toon, err := p.Reformat(input, EncodeOptions{})
+					if err != nil {
+						t.Fatalf("Reformat: %v", err)
+					}
+					if back, err := c.toTOON(p, got, EncodeOptions{}); err != nil || back != toon {
+						t.Fatalf("converting back gave\n%s%v\nwant\n%s", back, err, toon)
+					}
+				})
+			}
+		}
+	}
+}
+
+// fixtureDocuments returns the input and expected of a conversion test.
+func fixtureDocuments(t *testing.T, tc fixtureTest) (input, expected string) {
+	t.Helper()
+
+	if err := json.Unmarshal(tc.Input, &input); err != nil {
+		t.Fatalf("input must be a document as a string: %v", err)
+	}
+	if err := json.Unmarshal(tc.Expected, &expected); err != nil {
+		t.Fatalf("expected must be a document or an error message as a string: %v", err)
+	}
+	return input, expected
+}
+
+// checkConversion checks the result of a conversion, and reports whether
+// it succeeded as expected.
+func checkConversion(t *testing.T, got string, err error, want string, shouldError bool) bool {
+	t.Helper()
+
+	if shouldError {
+		if err == nil {
+			t.Fatalf("expected an error, got\n%s", got)
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q does not contain %q", err, want)
+		}
+		return false
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != want {
+		t.Fatalf("converted to\n%s\nwant\n%s", got, want)
+	}
+	return true
+}
+
+// checkRoundTrip writes value as TOON with opts and checks that it reads
+// back the same.
+func checkRoundTrip(t *testing.T, p *Parser, value interface{}, opts fixtureOptions) {
+	t.Helper()
+
+	toon, err := p.JSONToTOONWithOptions(mustJSON(value), opts.encode())
+	if err != nil {
+		t.Fatalf("round trip: JSONToTOON: %v", err)
+	}
+	data, err := p.ParseToonWithOptions(toon, opts.readback())
+	if err != nil {
+		t.Fatalf("round trip: reading back\n%s: %v", toon, err)
+	}
+	if !sameJSON(data.Value, value, false) {
+		t.Fatalf("round trip: read back %s from\n%s", mustJSON(data.Value), toon)
+	}
+}
+
+func checkParseError(t *testing.T, err error, reasons []Reason) {
+	t.Helper()
+
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected a *ParseError, got %v", err)
+	}
+	if reasons == nil {
+		return
+	}
+
+	got := make([]Reason, len(parseErr.Diagnostics))
+	for i, d := range parseErr.Diagnostics {
+		got[i] = d.Reason
+	}
+	if !reflect.DeepEqual(got, reasons) {
+		t.Fatalf("diagnostics have reasons %v, want %v\n%v", got, reasons, err)
+	}
+}
+
+// decodeFixtureJSON decodes JSON keeping the order of keys and the text of
+// numbers.
+func decodeFixtureJSON(t testing.TB, data json.RawMessage) interface{} {
+	t.Helper()
+
+	value, err := decodeOrderedJSON(data)
+	if err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return value
+}
+
+// sameJSON reports whether a and b are the same JSON value. Numbers are
+// compared as float64, which is what the parser reads them as. With ordered,
+// the keys of objects must also be in the same order.
+func sameJSON(a, b interface{}, ordered bool) bool {
+	aKeys, aFields, aIsObj := objectFields(a, false)
+	bKeys, bFields, bIsObj := objectFields(b, false)
+	if aIsObj || bIsObj {
+		if !aIsObj || !bIsObj || len(aKeys) != len(bKeys) {
+			return false
+		}
+		if ordered && !reflect.DeepEqual(aKeys, bKeys) {
+			return false
+		}
+		for _, key := range aKeys {
+			value, ok := bFields[key]
+			if !ok || !sameJSON(aFields[key], value, ordered) {
+				return false
+			}
+		}
+		return true
+	}
+
+	aItems, aIsArray := arrayItems(a)
+	bItems, bIsArray := arrayItems(b)
+	if aIsArray || bIsArray {
+		if !aIsArray || !bIsArray || len(aItems) != len(bItems) {
+			return false
+		}
+		for i := range aItems {
+			if !sameJSON(aItems[i], bItems[i], ordered) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if x, ok := jsonFloat(a); ok {
+		y, ok := jsonFloat(b)
+		return ok && x == y
+	}
+	return a == b
+}
+
+func jsonFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := strconv.ParseFloat(string(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func mustJSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,169 @@
+package parser
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ContextBuilder merges documents, the records of one or more collections,
+// into a single TOON document to put in a prompt.
+//
+// Each record becomes an object that starts with its key, as the field key,
+// unless the document has a field of that name, followed by the fields of
+// the document, or by the value of each field projection if there are any.
+// A document that is not an object is held by the field value. The records
+// of each collection are written under its name, and those of the same
+// shape, with the same primitive fields, are folded into one tabular array,
+// so that many small records cost little more than their values. A
+// collection with records of several shapes holds a list of its tables and
+// of the records that fit in none.
+type ContextBuilder struct {
+	parser  *Parser
+	fields  []*Path
+	records []contextRecord
+}
+
+type contextRecord struct {
+	collection string
+	value      *orderedMap
+	// shape names the fields of a record that can be a row of a table,
+	// and is empty for any other record.
+	shape string
+}
+
+// NewContextBuilder returns a ContextBuilder that keeps only the parts of
+// each document selected by the path expressions in fields, or the whole
+// documents if there are none. A path that selects nothing from a document
+// gives null.
+func (p *Parser) NewContextBuilder(fields []string) (*ContextBuilder, error) {
+	b := &ContextBuilder{parser: p}
+	for _, expr := range fields {
+		path, err := CompilePath(expr)
+		if err != nil {
+			return nil, err
+		}
+		b.fields = append(b.fields, path)
+	}
+	return b, nil
+}
+
+// Add reads a document strictly and adds it as the next record.
+func (b *ContextBuilder) Add(collection, key, toon string) error {
+	data, err := b.parser.decodeOrdered(toon)
+	if err != nil {
+		return err
+	}
+
+	record := newOrderedMap()
+	record.set("key", key)
+	switch {
+	case len(b.fields) > 0:
+		for _, path := range b.fields {
+			value, err := path.Eval(data)
+			if err != nil && !errors.Is(err, ErrPathNotFound) {
+				return err
+			}
+			record.set(path.String(), value)
+		}
+	case isObject(data):
+		keys, values, _ := objectFields(data, false)
+		for _, k := range keys {
+			record.set(k, values[k])
+		}
+	default:
+		record.set("value", data)
+	}
+
+	b.records = append(b.records, contextRecord{
+		collection: collection,
+		value:      record,
+		shape:      recordShape(record),
+	})
+	return nil
+}
+
+// recordShape returns the sorted names of the fields of record, or "" if
+// any of them is not a primitive.
+func recordShape(record *orderedMap) string {
+	for _, value := range record.values {
+		if _, isArray := arrayItems(value); isArray || isObject(value) {
+			return ""
+		}
+	}
+
+	keys := append([]string(nil), record.keys...)
+	sort.Strings(keys)
+	// Two shapes that join alike, through a NUL in a key, only lose their
+	// table, since the encoder checks the fields of a table itself
+	return strings.Join(keys, "\x00")
+}
+
+// Len returns the number of records added.
+func (b *ContextBuilder) Len() int {
+	return len(b.records)
+}
+
+// Document writes the first n records as a TOON document with opts. It
+// writes nothing for no records.
+func (b *ContextBuilder) Document(n int, opts EncodeOptions) (string, error) {
+	if err := opts.validate(); err != nil {
+		return "", err
+	}
+	if n > len(b.records) {
+		n = len(b.records)
+	}
+	records := b.records[:n]
+	if len(records) == 0 {
+		return "", nil
+	}
+
+	// Count the records of each shape, which form a table if there are
+	// two or more of them
+	type group struct {
+		collection, shape string
+	}
+	counts := make(map[group]int)
+	for _, r := range records {
+		if r.shape != "" {
+			counts[group{r.collection, r.shape}]++
+		}
+	}
+
+	// Collect the items of each collection in the order of their first
+	// records, where an item is a table or a record of its own
+	root := newOrderedMap()
+	items := make(map[string][]interface{})
+	tables := make(map[group]int)
+	for _, r := range records {
+		if _, ok := items[r.collection]; !ok {
+			root.set(r.collection, nil)
+		}
+
+		g := group{r.collection, r.shape}
+		if counts[g] < 2 {
+			items[r.collection] = append(items[r.collection], r.value)
+			continue
+		}
+		i, ok := tables[g]
+		if !ok {
+			i = len(items[r.collection])
+			tables[g] = i
+			items[r.collection] = append(items[r.collection], []interface{}{})
+		}
+		items[r.collection][i] = append(items[r.collection][i].([]interface{}), r.value)
+	}
+
+	// A collection that is a single table is written as that table
+	for _, collection := range root.keys {
+		list := items[collection]
+		if table, ok := list[0].([]interface{}); ok && len(list) == 1 {
+			list = table
+		}
+		root.set(collection, list)
+	}
+
+	var result strings.Builder
+	b.parser.documentToTOON(&result, root, opts)
+	return result.String(), nil
+}
@@ -0,0 +1,108 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContextBuilder(t *testing.T) {
+	p := NewParser()
+	b, err := p.NewContextBuilder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct{ collection, key, toon string }{
+		{"users", "u1", "name: Ada\nage: 36\n"},
+		{"users", "u2", "age: 41\nname: Bob\n"},
+		{"notes", "n1", "hello"},
+		// A key field of the document's own is kept over the record key
+		{"users", "u3", "key: own\nname: Cy\nage: 1\n"},
+		{"users", "u4", "name: Dee\ntags[2]: a,b\n"},
+		{"notes", "n2", "text: hi\n"},
+	} {
+		if err := b.Add(r.collection, r.key, r.toon); err != nil {
+			t.Fatalf("Add %s: %v", r.key, err)
+		}
+	}
+	if b.Len() != 6 {
+		t.Fatalf("Len = %d, want 6", b.Len())
+	}
+
+	for _, tc := range []struct {
+		n    int
+		want string
+	}{
+		{0, ""},
+		// Records of one shape, whatever the order of their fields, are a
+		// table, and so is a single record
+		{4, "users[3]{key,name,age}:\n" +
+			"  u1,Ada,36\n" +
+			"  u2,Bob,41\n" +
+			"  own,Cy,1\n" +
+			"notes[1]{key,value}:\n" +
+			"  n1,hello\n"},
+		// A collection of several shapes lists its tables and the records
+		// that fit in none
+		{10, "users[2]:\n" +
+			"  - [3]{key,name,age}:\n" +
+			"    u1,Ada,36\n" +
+			"    u2,Bob,41\n" +
+			"    own,Cy,1\n" +
+			"  - key: u4\n" +
+			"    name: Dee\n" +
+			"    tags[2]: a,b\n" +
+			"notes[2]:\n" +
+			"  - key: n1\n" +
+			"    value: hello\n" +
+			"  - key: n2\n" +
+			"    text: hi\n"},
+	} {
+		got, err := b.Document(tc.n, EncodeOptions{})
+		if err != nil {
+			t.Fatalf("Document(%d): %v", tc.n, err)
+		}
+		if got != tc.want {
+			t.Fatalf("Document(%d) gave\n%s\nwant\n%s", tc.n, got, tc.want)
+		}
+		if _, err := p.ParseToonWithOptions(got, DecodeOptions{Strict: true}); err != nil {
+			t.Fatalf("Document(%d) does not read back: %v", tc.n, err)
+		}
+	}
+
+	if _, err := b.Document(1, EncodeOptions{Indent: -1}); err == nil {
+		t.Fatal("Document accepted invalid options")
+	}
+}
+
+func TestContextBuilderFields(t *testing.T) {
+	p := NewParser()
+	if _, err := p.NewContextBuilder([]string{"a[["}); err == nil {
+		t.Fatal("NewContextBuilder accepted an invalid path")
+	}
+
+	b, err := p.NewContextBuilder([]string{"name", "address.city"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("users", "u1", "name: Ada\naddress:\n  city: Paris\n  zip: 75001\nage: 36\n"); err != nil {
+		t.Fatal(err)
+	}
+	// A path that selects nothing gives null
+	if err := b.Add("users", "u2", "name: Bob\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("users", "u3", "name: Cy\n  age: 1\n"); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("Add of a malformed document returned %v", err)
+	}
+
+	got, err := b.Document(b.Len(), EncodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "users[2]{key,name,address.city}:\n" +
+		"  u1,Ada,Paris\n" +
+		"  u2,Bob,null\n"
+	if got != want {
+		t.Fatalf("Document gave\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,614 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// NodeKind identifies what a Node holds.
+type NodeKind int
+
+const (
+	// FieldNode is a key with a value, an array, or nested fields.
+	FieldNode NodeKind = iota
+	// RowNode is one row of a tabular array.
+	RowNode
+	// ItemNode is one "- " item of an expanded list.
+	ItemNode
+	// ValueNode is the root of a document that is a single array or
+	// primitive rather than an object.
+	ValueNode
+	// CommentNode is a "#" comment line.
+	CommentNode
+	// BlankNode is an empty line.
+	BlankNode
+)
+
+// Header describes the array held by a node.
+type Header struct {
+	// Delimiter separates the values: ',', '\t' or '|'.
+	Delimiter byte
+	// Fields are the column names of a tabular array, and nil otherwise.
+	Fields []string
+}
+
+// Node is one element of a Document. Unlike the values returned by
+// ParseToon, nodes keep comments, blank lines and the order of fields, so a
+// document can be edited and printed back without losing its layout.
+//
+// A field, item or root value holds one of: a single value in Values; an
+// array, described by Header, with its values in Values, its rows or its
+// items in Children; or nested fields in Children. Array lengths are not
+// stored, they are counted when the document is printed.
+type Node struct {
+	Kind NodeKind
+	// Key is the unquoted key of a FieldNode.
+	Key string
+	// Header is set when the node holds an array.
+	Header *Header
+	// Values are the value tokens as written, such as `42` or `"a, b"`.
+	Values []string
+	// Comment is the text of a CommentNode after the "#".
+	Comment string
+	// Children are nested fields, rows or items, along with the comments
+	// and blank lines between them.
+	Children []*Node
+	// Line is where the node starts in the parsed source, or 0 for nodes
+	// added later.
+	Line int
+}
+
+// Value returns the value of a node that holds a single primitive, decoded
+// as by ParseToon, or nil otherwise.
+func (n *Node) Value() interface{} {
+	if n.Header != nil || len(n.Values) != 1 {
+		return nil
+	}
+	return parsePrimitive(n.Values[0])
+}
+
+// Field returns the nested field named key, or nil if there is none.
+func (n *Node) Field(key string) *Node {
+	return findField(n.Children, key)
+}
+
+// Document is a concrete syntax tree of a TOON document.
+type Document struct {
+	Nodes []*Node
+}
+
+// ParseDocument parses a TOON document into a Document. The document must be
+// well formed, except that its indentation may be off, since printing the
+// document normalizes it; otherwise a *ParseError lists its problems.
+func (p *Parser) ParseDocument(src string) (*Document, error) {
+	if err := p.Validate(strings.NewReader(src)); err != nil {
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			return nil, err
+		}
+		for _, diag := range parseErr.Diagnostics {
+			if diag.Reason != ReasonBadIndentation {
+				return nil, err
+			}
+		}
+	}
+
+	b := newCSTBuilder(src)
+	return &Document{Nodes: b.document()}, nil
+}
+
+// Field returns the field at path, following nested fields from the root,
+// or nil if there is none.
+func (doc *Document) Field(path ...string) *Node {
+	nodes := doc.Nodes
+	var n *Node
+	for _, key := range path {
+		if n = findField(nodes, key); n == nil {
+			return nil
+		}
+		nodes = n.Children
+	}
+	return n
+}
+
+// Set stores value at path, creating any missing parent objects. A field
+// that already exists keeps its place and the comments around it; only its
+// value is replaced. value may be anything Marshal accepts.
+func (doc *Document) Set(path []string, value interface{}) error {
+	if len(path) == 0 {
+		return fmt.Errorf("toon: empty path")
+	}
+	if !doc.isObject() {
+		return fmt.Errorf("toon: document is not an object")
+	}
+
+	tree, err := marshalValue(reflect.ValueOf(value))
+	if err != nil {
+		return err
+	}
+
+	nodes := &doc.Nodes
+	for _, key := range path[:len(path)-1] {
+		n := findField(*nodes, key)
+		if n == nil {
+			n = &Node{Kind: FieldNode, Key: key}
+			*nodes = append(*nodes, n)
+		} else if n.Header != nil || len(n.Values) > 0 {
+			// Replace a value that is not an object with one
+			n.Header, n.Values, n.Children = nil, nil, nil
+		}
+		nodes = &n.Children
+	}
+
+	key := path[len(path)-1]
+	field := fieldNode(key, tree)
+	if n := findField(*nodes, key); n != nil {
+		n.Header, n.Values, n.Children = field.Header, field.Values, field.Children
+		return nil
+	}
+	*nodes = append(*nodes, field)
+	return nil
+}
+
+// Delete removes the field at path and reports whether it was there.
+func (doc *Document) Delete(path ...string) bool {
+	if len(path) == 0 {
+		return false
+	}
+
+	nodes := &doc.Nodes
+	if len(path) > 1 {
+		parent := doc.Field(path[:len(path)-1]...)
+		if parent == nil {
+			return false
+		}
+		nodes = &parent.Children
+	}
+
+	for i, n := range *nodes {
+		if n.Kind == FieldNode && n.Key == path[len(path)-1] {
+			*nodes = append((*nodes)[:i], (*nodes)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// MergePatch applies patch to the document following the rules of JSON merge
+// patch (RFC 7386): each field of the patch is set in the document, a field
+// whose value is null is deleted, and fields holding nested objects are
+// merged recursively. A patch that is not an object replaces the whole
+// document. Fields the patch does not touch keep their place and the
+// comments around them. patch itself is not modified.
+func (doc *Document) MergePatch(patch *Document) {
+	if !patch.isObject() {
+		doc.Nodes = cloneNodes(patch.Nodes)
+		return
+	}
+	if !doc.isObject() {
+		doc.Nodes = nil
+	}
+	doc.Nodes = mergeFields(doc.Nodes, patch.Nodes)
+}
+
+// mergeFields merges the fields of a patch into the fields nodes and returns
+// the result.
+func mergeFields(nodes, patch []*Node) []*Node {
+	for _, p := range patch {
+		if p.Kind != FieldNode {
+			continue
+		}
+
+		if p.Header == nil && len(p.Values) == 1 && p.Values[0] == "null" {
+			for i, n := range nodes {
+				if n.Kind == FieldNode && n.Key == p.Key {
+					nodes = append(nodes[:i], nodes[i+1:]...)
+					break
+				}
+			}
+			continue
+		}
+
+		n := findField(nodes, p.Key)
+		if n == nil {
+			n = &Node{Kind: FieldNode, Key: p.Key}
+			nodes = append(nodes, n)
+		}
+
+		if p.Header == nil && len(p.Values) == 0 {
+			// A nested object is merged into the field, which becomes an
+			// object first if it held something else
+			if n.Header != nil || len(n.Values) > 0 {
+				n.Header, n.Values, n.Children = nil, nil, nil
+			}
+			n.Children = mergeFields(n.Children, p.Children)
+			continue
+		}
+
+		c := cloneNode(p)
+		n.Header, n.Values, n.Children = c.Header, c.Values, c.Children
+	}
+	return nodes
+}
+
+func cloneNodes(nodes []*Node) []*Node {
+	if nodes == nil {
+		return nil
+	}
+	clones := make([]*Node, len(nodes))
+	for i, n := range nodes {
+		clones[i] = cloneNode(n)
+	}
+	return clones
+}
+
+// cloneNode returns a deep copy of n, so that a patch can be applied to
+// several documents.
+func cloneNode(n *Node) *Node {
+	c := *n
+	if n.Header != nil {
+		header := *n.Header
+		header.Fields = append([]string(nil), n.Header.Fields...)
+		c.Header = &header
+	}
+	c.Values = append([]string(nil), n.Values...)
+	c.Children = cloneNodes(n.Children)
+	return &c
+}
+
+// String prints the document with canonical indentation and quoting.
+// Comments, blank lines and the order of fields are kept as they are.
+func (doc *Document) String() string {
+	var b strings.Builder
+	writeNodes(&b, doc.Nodes, 0)
+	return b.String()
+}
+
+func (doc *Document) isObject() bool {
+	for _, n := range doc.Nodes {
+		if n.Kind == ValueNode {
+			return false
+		}
+	}
+	return true
+}
+
+func findField(nodes []*Node, key string) *Node {
+	for _, n := range nodes {
+		if n.Kind == FieldNode && n.Key == key {
+			return n
+		}
+	}
+	return nil
+}
+
+// fieldNode builds the node of the field key: value, where value is a tree
+// as built by marshalValue.
+func fieldNode(key string, value interface{}) *Node {
+	var text strings.Builder
+	p := &Parser{}
+	p.fieldToTOON(&text, "", key, value, 0, EncodeOptions{})
+
+	b := newCSTBuilder(text.String())
+	return b.fields(0)[0]
+}
+
+// cstLine is a line of source kept by the CST builder, including blank and
+// comment lines.
+type cstLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+func (ln cstLine) content() bool {
+	return ln.text != "" && !strings.HasPrefix(ln.text, "#")
+}
+
+// cstBuilder builds nodes from a document that has already been validated,
+// so it does not report problems of its own.
+type cstBuilder struct {
+	lines []cstLine
+	pos   int
+}
+
+func newCSTBuilder(src string) *cstBuilder {
+	b := &cstBuilder{}
+	for i, raw := range strings.Split(strings.TrimSuffix(src, "\n"), "\n") {
+		text := strings.TrimSpace(raw)
+		indent := len(raw) - len(strings.TrimLeft(raw, " \t"))
+		b.lines = append(b.lines, cstLine{num: i + 1, indent: indent, text: text})
+	}
+	if src == "" {
+		b.lines = nil
+	}
+	return b
+}
+
+// nextIndent returns the indentation of the next line with content, or 0 at
+// the end of the document. Comments and blank lines belong to the block of
+// the content that follows them.
+func (b *cstBuilder) nextIndent() int {
+	for _, ln := range b.lines[b.pos:] {
+		if ln.content() {
+			return ln.indent
+		}
+	}
+	return 0
+}
+
+// aside returns the node of a blank or comment line.
+func aside(ln cstLine) *Node {
+	if ln.text == "" {
+		return &Node{Kind: BlankNode, Line: ln.num}
+	}
+	return &Node{Kind: CommentNode, Comment: strings.TrimPrefix(ln.text, "#"), Line: ln.num}
+}
+
+func (b *cstBuilder) document() []*Node {
+	var nodes []*Node
+	var content []cstLine
+	for _, ln := range b.lines {
+		if ln.content() {
+			content = append(content, ln)
+		}
+	}
+
+	isRootArray := len(content) > 0 && strings.HasPrefix(content[0].text, "[") && isArrayHeader(content[0].text)
+	isRootValue := false
+	if len(content) == 1 && !isRootArray {
+		_, rest, ok := splitKey(content[0].text)
+		isRootValue = !ok || rest == ""
+	}
+	if !isRootArray && !isRootValue {
+		// Root fields may be indented; the root object never closes
+		return b.block(0, false, b.field)
+	}
+
+	for b.pos < len(b.lines) {
+		ln := b.lines[b.pos]
+		b.pos++
+		if !ln.content() {
+			nodes = append(nodes, aside(ln))
+			continue
+		}
+
+		root := &Node{Kind: ValueNode, Line: ln.num}
+		if isRootArray {
+			b.array(root, ln.indent, ln.text)
+		} else {
+			root.Values = []string{ln.text}
+		}
+		nodes = append(nodes, root)
+	}
+	return nodes
+}
+
+// block collects the nodes of the lines indented at least indent, building
+// each line with content using build. The lines are grouped the same way the
+// decoder groups them, even when they are not indented consistently: with
+// align set, the first line fixes the indentation of the block, as it does
+// for the fields of an object.
+func (b *cstBuilder) block(indent int, align bool, build func(ln cstLine) *Node) []*Node {
+	var nodes []*Node
+	aligned := false
+	for b.pos < len(b.lines) {
+		ln := b.lines[b.pos]
+		if !ln.content() {
+			if b.nextIndent() < indent {
+				break
+			}
+			nodes = append(nodes, aside(ln))
+			b.pos++
+			continue
+		}
+		if ln.indent < indent {
+			break
+		}
+		if align && !aligned {
+			indent, aligned = ln.indent, true
+		}
+
+		b.pos++
+		nodes = append(nodes, build(ln))
+	}
+	return nodes
+}
+
+func (b *cstBuilder) fields(indent int) []*Node {
+	return b.block(indent, true, b.field)
+}
+
+func (b *cstBuilder) field(ln cstLine) *Node {
+	key, rest, _ := splitKey(ln.text)
+	n := &Node{Kind: FieldNode, Key: key, Line: ln.num}
+
+	if isArrayHeader(rest) {
+		b.array(n, ln.indent, rest)
+		return n
+	}
+
+	if value := strings.TrimSpace(strings.TrimPrefix(rest, ":")); value != "" {
+		n.Values = []string{value}
+		return n
+	}
+
+	n.Children = b.fields(ln.indent + 1)
+	return n
+}
+
+// array fills in n from the array header found on a line at indent,
+// reading its rows or items from the lines that follow.
+func (b *cstBuilder) array(n *Node, indent int, header string) {
+	h, _ := scanArrayHeader(header)
+	if h.table {
+		n.Header = &Header{Delimiter: h.delim, Fields: h.fields}
+		n.Children = b.block(indent+1, false, func(ln cstLine) *Node {
+			return &Node{Kind: RowNode, Values: splitDelimited(ln.text, h.delim), Line: ln.num}
+		})
+		return
+	}
+
+	n.Header = &Header{Delimiter: h.delim}
+	if h.rest != "" {
+		n.Values = splitDelimited(h.rest, h.delim)
+		return
+	}
+	if h.size > 0 {
+		n.Children = b.block(indent+1, false, b.item)
+	}
+}
+
+func (b *cstBuilder) item(ln cstLine) *Node {
+	n := &Node{Kind: ItemNode, Line: ln.num}
+	text := strings.TrimSpace(strings.TrimPrefix(ln.text, "-"))
+	if text == "" {
+		return n
+	}
+
+	if strings.HasPrefix(text, "[") && isArrayHeader(text) {
+		b.array(n, ln.indent, text)
+		return n
+	}
+
+	if _, rest, ok := splitKey(text); ok && rest != "" {
+		first := b.field(cstLine{num: ln.num, indent: ln.indent + indentSize, text: text})
+		rest := b.block(ln.indent+indentSize, false, b.field)
+		n.Children = append([]*Node{first}, rest...)
+		return n
+	}
+
+	n.Values = []string{text}
+	return n
+}
+
+func writeNodes(b *strings.Builder, nodes []*Node, indent int) {
+	pad := strings.Repeat("  ", indent)
+	for _, n := range nodes {
+		switch n.Kind {
+		case BlankNode:
+			b.WriteString("\n")
+		case CommentNode:
+			b.WriteString(pad + "#" + n.Comment + "\n")
+		case FieldNode:
+			writeEntry(b, n, pad, formatKey(n.Key), indent)
+		case ValueNode:
+			writeEntry(b, n, pad, "", indent)
+		case ItemNode:
+			writeItem(b, n, indent)
+		}
+	}
+}
+
+// writeEntry writes a field or root value whose first line starts with lead
+// followed by name. Its nested fields, rows or items go one level deeper
+// than indent.
+func writeEntry(b *strings.Builder, n *Node, lead, name string, indent int) {
+	b.WriteString(lead + name)
+
+	if h := n.Header; h != nil {
+		delim := h.Delimiter
+		if delim == 0 {
+			delim = ','
+		}
+
+		rows, items := 0, 0
+		for _, child := range n.Children {
+			switch child.Kind {
+			case RowNode:
+				rows++
+			case ItemNode:
+				items++
+			}
+		}
+
+		switch {
+		case h.Fields != nil:
+			header := make([]string, len(h.Fields))
+			for i, field := range h.Fields {
+				header[i] = formatKey(field)
+			}
+			fmt.Fprintf(b, "[%d%s]{%s}:\n", rows, delimiterMarker(delim), strings.Join(header, string(delim)))
+			writeRows(b, n.Children, delim, indent+1)
+		case items > 0:
+			fmt.Fprintf(b, "[%d]:\n", items)
+			writeNodes(b, n.Children, indent+1)
+		case len(n.Values) == 0:
+			b.WriteString("[0]:\n")
+		default:
+			fmt.Fprintf(b, "[%d%s]: %s\n", len(n.Values), delimiterMarker(delim), joinTokens(n.Values, delim))
+		}
+		return
+	}
+
+	if len(n.Values) > 0 {
+		if name != "" {
+			b.WriteString(": ")
+		}
+		b.WriteString(normalizeToken(n.Values[0], 0) + "\n")
+		return
+	}
+
+	if n.Kind == ValueNode {
+		return
+	}
+	b.WriteString(":\n")
+	writeNodes(b, n.Children, indent+1)
+}
+
+// writeItem writes a list item whose "- " marker sits at indent. The first
+// field of an object item shares the marker's line.
+func writeItem(b *strings.Builder, n *Node, indent int) {
+	pad := strings.Repeat("  ", indent)
+	if n.Header != nil || len(n.Values) > 0 {
+		writeEntry(b, n, pad+"- ", "", indent)
+		return
+	}
+
+	first := -1
+	for i, child := range n.Children {
+		if child.Kind == FieldNode {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		b.WriteString(pad + "-\n")
+		return
+	}
+
+	// Comments above the first field go above the marker
+	writeNodes(b, n.Children[:first], indent)
+	writeEntry(b, n.Children[first], pad+"- ", formatKey(n.Children[first].Key), indent+1)
+	writeNodes(b, n.Children[first+1:], indent+1)
+}
+
+func writeRows(b *strings.Builder, nodes []*Node, delim byte, indent int) {
+	pad := strings.Repeat("  ", indent)
+	for _, n := range nodes {
+		if n.Kind == RowNode {
+			b.WriteString(pad + joinTokens(n.Values, delim) + "\n")
+			continue
+		}
+		writeNodes(b, []*Node{n}, indent)
+	}
+}
+
+func joinTokens(tokens []string, delim byte) string {
+	normalized := make([]string, len(tokens))
+	for i, token := range tokens {
+		normalized[i] = normalizeToken(token, delim)
+	}
+	return strings.Join(normalized, string(delim))
+}
+
+// normalizeToken rewrites a string token so it is quoted only when it needs
+// to be. Other tokens, such as numbers, are kept as written.
+func normalizeToken(token string, delim byte) string {
+	if s, ok := parsePrimitive(token).(string); ok {
+		return formatString(s, delim)
+	}
+	return token
+}
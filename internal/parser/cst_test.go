@@ -0,0 +1,144 @@
+package parser
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the .golden files of the format tests")
+
+// TestDocumentString formats each document in testdata/format, which must
+// give its .golden file, keeping every comment and blank line, and must not
+// change when formatted again.
+func TestDocumentString(t *testing.T) {
+	p := NewParser()
+	paths, err := filepath.Glob(filepath.Join("testdata", "format", "*.toon"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no format tests found: %v", err)
+	}
+
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := p.ParseDocument(string(src))
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		got := doc.String()
+
+		golden := strings.TrimSuffix(path, ".toon") + ".golden"
+		if *update {
+			if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s formats as\n%s\nwant\n%s", path, got, want)
+			continue
+		}
+
+		again, err := p.ParseDocument(got)
+		if err != nil {
+			t.Fatalf("%s: reading the formatted document: %v", path, err)
+		}
+		if again.String() != got {
+			t.Errorf("%s: formatting again gives\n%s", path, again.String())
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	p := NewParser()
+	for _, tc := range []struct {
+		name             string
+		doc, patch, want string
+	}{
+		{
+			name:  "null deletes a field",
+			doc:   "a: 1\nb: 2\nc: 3\n",
+			patch: "b: null\nmissing: null\n",
+			want:  "a: 1\nc: 3\n",
+		},
+		{
+			name:  "nested objects merge",
+			doc:   "user:\n  name: Ada\n  address:\n    city: Paris\n    zip: 75001\n",
+			patch: "user:\n  address:\n    city: Lyon\n    zip: null\n  age: 36\n",
+			want:  "user:\n  name: Ada\n  address:\n    city: Lyon\n  age: 36\n",
+		},
+		{
+			name:  "new fields are added at the end",
+			doc:   "a: 1\n",
+			patch: "b:\n  c: 2\nd[2]: x,y\n",
+			want:  "a: 1\nb:\n  c: 2\nd[2]: x,y\n",
+		},
+		{
+			name:  "comments and untouched fields keep their place",
+			doc:   "# settings\na: 1\n\n# the limit\nlimit: 10\nz: last\n",
+			patch: "limit: 20\na: null\n",
+			want:  "# settings\n\n# the limit\nlimit: 20\nz: last\n",
+		},
+		{
+			name:  "a patch that is not an object replaces the document",
+			doc:   "a: 1\n",
+			patch: "[2]: 1,2\n",
+			want:  "[2]: 1,2\n",
+		},
+		{
+			name:  "a primitive patch replaces the document",
+			doc:   "a: 1\n",
+			patch: "hello\n",
+			want:  "hello\n",
+		},
+		{
+			name:  "an object patch replaces a document that is not an object",
+			doc:   "[2]: 1,2\n",
+			patch: "a: 1\n",
+			want:  "a: 1\n",
+		},
+		{
+			name:  "an object is merged into a field holding an array",
+			doc:   "tags[2]: a,b\nrows[1]{id}:\n  1\n",
+			patch: "tags:\n  x: 1\n",
+			want:  "tags:\n  x: 1\nrows[1]{id}:\n  1\n",
+		},
+		{
+			name:  "an object is merged into a field holding a primitive",
+			doc:   "a: 1\n",
+			patch: "a:\n  b: 2\n",
+			want:  "a:\n  b: 2\n",
+		},
+		{
+			name:  "arrays replace the field whole",
+			doc:   "tags[3]: a,b,c\nobj:\n  k: v\n",
+			patch: "tags[1]: d\nobj[2]: 1,2\n",
+			want:  "tags[1]: d\nobj[2]: 1,2\n",
+		},
+	} {
+		doc, err := p.ParseDocument(tc.doc)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		patch, err := p.ParseDocument(tc.patch)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		before := patch.String()
+
+		doc.MergePatch(patch)
+		if got := doc.String(); got != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+		if patch.String() != before {
+			t.Errorf("%s: the patch was modified", tc.name)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package parser
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteCSV writes the table as RFC 4180 CSV: a header row of the field names
+// followed by one record per row. Strings are written as they are, null as
+// an empty cell, and other values as in TOON. A table with no fields yet
+// writes nothing.
+func (t *Table) WriteCSV(w io.Writer) error {
+	fields := t.Fields()
+	if len(fields) == 0 {
+		return nil
+	}
+
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = true
+	if err := cw.Write(fields); err != nil {
+		return err
+	}
+
+	record := make([]string, len(fields))
+	for _, row := range t.rows() {
+		values := t.values(row)
+		for i, field := range fields {
+			record[i] = csvCell(values[field])
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	return formatPrimitive(value, 0)
+}
+
+// ReadCSV replaces the fields and rows of the table with those of a CSV
+// document, whose first record names the fields. Comments between the old
+// rows are dropped, and the delimiter of the table is kept.
+//
+// CSV has no types, so they are inferred for each column from all of its
+// cells: a column whose cells are all numbers holds numbers, one whose cells
+// are all true or false, in any case, holds booleans, and any other column
+// holds strings, so that codes such as 007 in a column of codes stay
+// strings. Empty cells are null in every column.
+func (t *Table) ReadCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	records, err := cr.ReadAll()
+	if err != nil {
+		return fmt.Errorf("toon: invalid CSV: %v", err)
+	}
+	if len(records) == 0 {
+		return errors.New("toon: empty CSV, expected a header row of field names")
+	}
+
+	fields := records[0]
+	// Spreadsheets often start the file with a byte order mark
+	fields[0] = strings.TrimPrefix(fields[0], "\ufeff")
+	seen := make(map[string]bool, len(fields))
+	for i, field := range fields {
+		if field == "" {
+			return fmt.Errorf("toon: CSV column %d has no name", i+1)
+		}
+		if seen[field] {
+			return fmt.Errorf("toon: CSV has two columns named %q", field)
+		}
+		seen[field] = true
+	}
+
+	records = records[1:]
+	rows := make([]*Node, len(records))
+	for i := range rows {
+		rows[i] = &Node{Kind: RowNode, Values: make([]string, len(fields))}
+	}
+	for j := range fields {
+		parse := csvColumnType(records, j)
+		for i, record := range records {
+			rows[i].Values[j] = formatPrimitive(parse(record[j]), 0)
+		}
+	}
+
+	t.node.Header.Fields = fields
+	t.node.Children = rows
+	return nil
+}
+
+// csvColumnType returns the function that reads the cells of column j.
+func csvColumnType(records [][]string, j int) func(cell string) interface{} {
+	numbers, bools := true, true
+	for _, record := range records {
+		cell := record[j]
+		if cell == "" {
+			continue
+		}
+		if !isNumber(cell) {
+			numbers = false
+		}
+		if !strings.EqualFold(cell, "true") && !strings.EqualFold(cell, "false") {
+			bools = false
+		}
+	}
+
+	return func(cell string) interface{} {
+		switch {
+		case cell == "":
+			return nil
+		case numbers:
+			return parsePrimitive(cell)
+		case bools:
+			return strings.EqualFold(cell, "true")
+		}
+		return cell
+	}
+}
@@ -0,0 +1,78 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCSVRoundTrip(t *testing.T) {
+	p := NewParser()
+	doc, err := p.ParseDocument("# users\nusers[1]{id,name}:\n  1,Ada\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := doc.Table("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The document starts with a byte order mark, the code column stays
+	// strings for 007, and the note column for its mix of strings and a
+	// boolean
+	csv := "\ufeffid,code,active,score,note\r\n" +
+		"1,007,TRUE,1.5,\r\n" +
+		"2,042,false,,\"a, b\"\r\n" +
+		"3,7,,-2,true\r\n"
+	if err := table.ReadCSV(strings.NewReader(csv)); err != nil {
+		t.Fatalf("ReadCSV: %v", err)
+	}
+	want := "# users\n" +
+		"users[3]{id,code,active,score,note}:\n" +
+		"  1,\"007\",true,1.5,null\n" +
+		"  2,\"042\",false,null,\"a, b\"\n" +
+		"  3,\"7\",null,-2,\"true\"\n"
+	if got := doc.String(); got != want {
+		t.Fatalf("ReadCSV gave\n%s\nwant\n%s", got, want)
+	}
+
+	var b strings.Builder
+	if err := table.WriteCSV(&b); err != nil {
+		t.Fatalf("WriteCSV: %v", err)
+	}
+	want = "id,code,active,score,note\r\n" +
+		"1,007,true,1.5,\r\n" +
+		"2,042,false,,\"a, b\"\r\n" +
+		"3,7,,-2,true\r\n"
+	if got := b.String(); got != want {
+		t.Fatalf("WriteCSV gave %q, want %q", got, want)
+	}
+}
+
+func TestReadCSVErrors(t *testing.T) {
+	p := NewParser()
+	for _, tc := range []struct {
+		csv, want string
+	}{
+		{"", "empty CSV"},
+		{"id,,name\n", "column 2 has no name"},
+		{"id,name,id\n", `two columns named "id"`},
+		{"id,name\n1\n", "invalid CSV"},
+	} {
+		doc, err := p.ParseDocument("rows[0]:\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		table, err := doc.Table("rows")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := table.ReadCSV(strings.NewReader(tc.csv)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("ReadCSV(%q) returned %v, want an error containing %q", tc.csv, err, tc.want)
+		}
+
+		var b strings.Builder
+		if err := table.WriteCSV(&b); err != nil || b.Len() > 0 {
+			t.Errorf("WriteCSV of a table with no fields wrote %q, %v", b.String(), err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ChangeKind says how a value differs between two documents.
+type ChangeKind string
+
+const (
+	ChangeAdded    ChangeKind = "added"
+	ChangeRemoved  ChangeKind = "removed"
+	ChangeModified ChangeKind = "modified"
+)
+
+// Change is one difference between two documents. Path is written in the
+// syntax of CompilePath and locates the value in the new document, or for a
+// removed value in the old one; the empty path is the whole document.
+// Old is nil for an added value and New for a removed one.
+type Change struct {
+	Kind ChangeKind  `json:"kind"`
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// maxDiffCells bounds the work of matching up the elements of two arrays:
+// the product of their lengths once the elements they share at each end are
+// set aside. Arrays over it are compared index by index instead.
+const maxDiffCells = 1 << 20
+
+// Diff compares two decoded documents, such as the Value of two ToonData,
+// and returns the changes that turn from into to, in the order of their
+// paths, with object keys sorted.
+//
+// Objects are compared field by field. Arrays, including the rows of
+// tables, are matched up by their longest common run of equal elements, so
+// a row inserted or removed in the middle of a table is reported as a
+// single added or removed row. An element replaced by a similar one, such
+// as a table row with some of its fields edited, is compared with it, so
+// that only the changed fields are reported.
+//
+// Numbers are equal if they have the same value, whatever their type.
+func Diff(from, to interface{}) []Change {
+	var changes []Change
+	diffValues(&changes, "", "", from, to)
+	return changes
+}
+
+// diffValues compares from, at oldPath in the old document, with to, at
+// newPath in the new one.
+func diffValues(changes *[]Change, oldPath, newPath string, from, to interface{}) {
+	if fromKeys, fromFields, ok := objectFields(from, true); ok {
+		if toKeys, toFields, ok := objectFields(to, true); ok {
+			diffObjects(changes, oldPath, newPath, fromKeys, fromFields, toKeys, toFields)
+			return
+		}
+	}
+
+	if a, ok := arrayItems(from); ok {
+		if b, ok := arrayItems(to); ok {
+			diffArrays(changes, oldPath, newPath, a, b)
+			return
+		}
+	}
+
+	if !equalValues(from, to) {
+		*changes = append(*changes, Change{Kind: ChangeModified, Path: newPath, Old: from, New: to})
+	}
+}
+
+// diffObjects compares two objects given by their sorted keys and fields.
+func diffObjects(changes *[]Change, oldPath, newPath string, fromKeys []string, from map[string]interface{}, toKeys []string, to map[string]interface{}) {
+	i, j := 0, 0
+	for i < len(fromKeys) || j < len(toKeys) {
+		switch {
+		case j == len(toKeys) || i < len(fromKeys) && fromKeys[i] < toKeys[j]:
+			key := fromKeys[i]
+			*changes = append(*changes, Change{Kind: ChangeRemoved, Path: fieldPath(oldPath, key), Old: from[key]})
+			i++
+		case i == len(fromKeys) || toKeys[j] < fromKeys[i]:
+			key := toKeys[j]
+			*changes = append(*changes, Change{Kind: ChangeAdded, Path: fieldPath(newPath, key), New: to[key]})
+			j++
+		default:
+			key := fromKeys[i]
+			diffValues(changes, fieldPath(oldPath, key), fieldPath(newPath, key), from[key], to[key])
+			i++
+			j++
+		}
+	}
+}
+
+// diffArrays compares two arrays by matching up their elements.
+func diffArrays(changes *[]Change, oldPath, newPath string, from, to []interface{}) {
+	// Set aside the elements the arrays share at each end, which is all
+	// but a few for the usual edit, such as rows appended to a log
+	start := 0
+	for start < len(from) && start < len(to) && equalValues(from[start], to[start]) {
+		start++
+	}
+	end := 0
+	for end < len(from)-start && end < len(to)-start && equalValues(from[len(from)-1-end], to[len(to)-1-end]) {
+		end++
+	}
+	a, b := from[start:len(from)-end], to[start:len(to)-end]
+
+	if len(a)*len(b) > maxDiffCells {
+		for i := 0; i < len(a) || i < len(b); i++ {
+			switch {
+			case i >= len(b):
+				*changes = append(*changes, Change{Kind: ChangeRemoved, Path: indexPath(oldPath, start+i), Old: a[i]})
+			case i >= len(a):
+				*changes = append(*changes, Change{Kind: ChangeAdded, Path: indexPath(newPath, start+i), New: b[i]})
+			default:
+				diffValues(changes, indexPath(oldPath, start+i), indexPath(newPath, start+i), a[i], b[i])
+			}
+		}
+		return
+	}
+
+	// lcs[i*(len(b)+1)+j] is the length of the longest common subsequence
+	// of a[i:] and b[j:]
+	width := len(b) + 1
+	lcs := make([]int32, (len(a)+1)*width)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case equalValues(a[i], b[j]):
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			case lcs[(i+1)*width+j] >= lcs[i*width+j+1]:
+				lcs[i*width+j] = lcs[(i+1)*width+j]
+			default:
+				lcs[i*width+j] = lcs[i*width+j+1]
+			}
+		}
+	}
+
+	// Walk the common subsequence, collecting the elements between two of
+	// its matches as a gap of removed and added elements
+	var removed, added []int
+	flush := func() {
+		diffGap(changes, oldPath, newPath, start, a, b, removed, added)
+		removed, added = removed[:0], added[:0]
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && equalValues(a[i], b[j]):
+			flush()
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[(i+1)*width+j] >= lcs[i*width+j+1]:
+			removed = append(removed, i)
+			i++
+		default:
+			added = append(added, j)
+			j++
+		}
+	}
+	flush()
+}
+
+// diffGap reports the elements removed from and added to an array between
+// two elements they share, given by their indexes in a and b. An element
+// replaced by a similar one is compared with it instead, pairing them in
+// order; the rest are reported whole.
+func diffGap(changes *[]Change, oldPath, newPath string, start int, a, b []interface{}, removed, added []int) {
+	j := 0
+	for _, i := range removed {
+		k := j
+		for k < len(added) && !similarValues(a[i], b[added[k]]) {
+			k++
+		}
+		if k == len(added) {
+			*changes = append(*changes, Change{Kind: ChangeRemoved, Path: indexPath(oldPath, start+i), Old: a[i]})
+			continue
+		}
+
+		for ; j < k; j++ {
+			*changes = append(*changes, Change{Kind: ChangeAdded, Path: indexPath(newPath, start+added[j]), New: b[added[j]]})
+		}
+		diffValues(changes, indexPath(oldPath, start+i), indexPath(newPath, start+added[k]), a[i], b[added[k]])
+		j = k + 1
+	}
+	for ; j < len(added); j++ {
+		*changes = append(*changes, Change{Kind: ChangeAdded, Path: indexPath(newPath, start+added[j]), New: b[added[j]]})
+	}
+}
+
+// similarValues reports whether b may be an edited a: two objects that have
+// at least half of their fields the same, or two values that are not
+// objects.
+func similarValues(a, b interface{}) bool {
+	aKeys, aFields, aIsObj := objectFields(a, false)
+	bKeys, bFields, bIsObj := objectFields(b, false)
+	if !aIsObj || !bIsObj {
+		return !aIsObj && !bIsObj
+	}
+
+	same, shared := 0, 0
+	for _, key := range aKeys {
+		if value, ok := bFields[key]; ok {
+			shared++
+			if equalValues(aFields[key], value) {
+				same++
+			}
+		}
+	}
+	return same > 0 && 2*same >= len(aKeys)+len(bKeys)-shared
+}
+
+// equalValues reports whether two decoded values are the same.
+func equalValues(a, b interface{}) bool {
+	if aKeys, aFields, ok := objectFields(a, false); ok {
+		bKeys, bFields, ok := objectFields(b, false)
+		if !ok || len(aKeys) != len(bKeys) {
+			return false
+		}
+		for _, key := range aKeys {
+			value, ok := bFields[key]
+			if !ok || !equalValues(aFields[key], value) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if aItems, ok := arrayItems(a); ok {
+		bItems, ok := arrayItems(b)
+		if !ok || len(aItems) != len(bItems) {
+			return false
+		}
+		for i := range aItems {
+			if !equalValues(aItems[i], bItems[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if isObject(b) {
+		return false
+	}
+	if _, ok := arrayItems(b); ok {
+		return false
+	}
+	cmp, comparable := compareValues(a, b)
+	return comparable && cmp == 0
+}
+
+// fieldPath returns the path of the field key of the object at path,
+// quoting the key if it would not read back as a single key.
+func fieldPath(path, key string) string {
+	if key == "" || strings.ContainsAny(key, `.[]"`) {
+		key = quote(key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// indexPath returns the path of element i of the array at path.
+func indexPath(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
@@ -0,0 +1,79 @@
+package parser
+
+import (
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	p := NewParser()
+	for _, tc := range []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{
+			name: "row inserted in the middle",
+			from: "rows[3]{id,name}:\n  1,a\n  2,b\n  3,c\n",
+			to:   "rows[4]{id,name}:\n  1,a\n  2,b\n  9,z\n  3,c\n",
+			want: `[{"kind":"added","path":"rows[2]","old":null,"new":{"id":9,"name":"z"}}]`,
+		},
+		{
+			name: "row removed",
+			from: "rows[3]{id,name}:\n  1,a\n  2,b\n  3,c\n",
+			to:   "rows[2]{id,name}:\n  1,a\n  3,c\n",
+			want: `[{"kind":"removed","path":"rows[1]","old":{"id":2,"name":"b"},"new":null}]`,
+		},
+		{
+			name: "edited row",
+			from: "rows[3]{id,name,qty}:\n  1,a,1\n  2,b,2\n  3,c,3\n",
+			to:   "rows[3]{id,name,qty}:\n  1,a,1\n  2,b,5\n  3,c,3\n",
+			want: `[{"kind":"modified","path":"rows[1].qty","old":2,"new":5}]`,
+		},
+		{
+			name: "edited row after an inserted one",
+			from: "rows[3]{id,name,qty}:\n  1,a,1\n  2,b,2\n  3,c,3\n",
+			to:   "rows[4]{id,name,qty}:\n  1,a,1\n  9,z,9\n  2,b,5\n  3,c,3\n",
+			want: `[{"kind":"added","path":"rows[1]","old":null,"new":{"id":9,"name":"z","qty":9}},` +
+				`{"kind":"modified","path":"rows[2].qty","old":2,"new":5}]`,
+		},
+		{
+			name: "row replaced by one too different to be an edit",
+			from: "rows[2]{id,name,qty}:\n  1,a,1\n  2,b,2\n",
+			to:   "rows[2]{id,name,qty}:\n  1,a,1\n  2,x,5\n",
+			want: `[{"kind":"removed","path":"rows[1]","old":{"id":2,"name":"b","qty":2},"new":null},` +
+				`{"kind":"added","path":"rows[1]","old":null,"new":{"id":2,"name":"x","qty":5}}]`,
+		},
+		{
+			name: "nested objects",
+			from: "a:\n  b:\n    c: 1\n    d: 2\n  e: x\n",
+			to:   "a:\n  b:\n    c: 1\n    d: 3\n    f: true\n",
+			want: `[{"kind":"modified","path":"a.b.d","old":2,"new":3},` +
+				`{"kind":"added","path":"a.b.f","old":null,"new":true},` +
+				`{"kind":"removed","path":"a.e","old":"x","new":null}]`,
+		},
+		{
+			name: "array becomes an object",
+			from: "v[2]: 1,2\n",
+			to:   "v:\n  x: 1\n",
+			want: `[{"kind":"modified","path":"v","old":[1,2],"new":{"x":1}}]`,
+		},
+		{
+			name: "numbers of either type",
+			from: "n: 1\nm: 1.5\n",
+			to:   "n: 1.0\nm: 1.5\n",
+			want: `null`,
+		},
+	} {
+		from, err := p.ParseToon(tc.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		to, err := p.ParseToon(tc.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mustJSON(Diff(from.Value, to.Value)); got != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+	}
+}
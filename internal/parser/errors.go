@@ -0,0 +1,49 @@
+package parser
+
+import "fmt"
+
+// Reason classifies a Diagnostic.
+type Reason string
+
+const (
+	ReasonSyntax          Reason = "syntax"
+	ReasonLengthMismatch  Reason = "length_mismatch"
+	ReasonRowWidth        Reason = "row_width_mismatch"
+	ReasonBadIndentation  Reason = "bad_indentation"
+	ReasonDuplicateKey    Reason = "duplicate_key"
+	ReasonBadEscape       Reason = "bad_escape"
+	ReasonPathConflict    Reason = "path_conflict"
+	ReasonLimitExceeded   Reason = "limit_exceeded"
+	ReasonTooManyProblems Reason = "too_many_problems"
+)
+
+// Diagnostic is a single problem found in a TOON document. Line and Column
+// are 1-based.
+type Diagnostic struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Reason  Reason `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("line %d, column %d: %s", d.Line, d.Column, d.Message)
+}
+
+// ParseError is returned by strict parsing and lists every problem found in
+// the document, in order of appearance.
+type ParseError struct {
+	Diagnostics []Diagnostic
+}
+
+func (e *ParseError) Error() string {
+	if len(e.Diagnostics) == 0 {
+		return "invalid TOON document"
+	}
+
+	msg := e.Diagnostics[0].String()
+	if more := len(e.Diagnostics) - 1; more > 0 {
+		msg += fmt.Sprintf(" (and %d more)", more)
+	}
+	return msg
+}
@@ -0,0 +1,112 @@
+package parser
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// FuzzParseToon reads arbitrary documents, which must never panic, and
+// checks that the ways of reading a document of valid UTF-8 agree: strict
+// parsing and Validate accept the same documents, and a document that is
+// accepted reads back the same after Reformat, ToonToJSON and a pass
+// through the CST.
+func FuzzParseToon(f *testing.F) {
+	for _, file := range loadFixtures(f, "decode") {
+		for _, tc := range file.Tests {
+			var input string
+			if json.Unmarshal(tc.Input, &input) == nil {
+				f.Add(input)
+			}
+		}
+	}
+	f.Add(nestedDocument())
+
+	p := NewParser()
+	f.Fuzz(func(t *testing.T, input string) {
+		if _, err := p.ParseToon(input); err != nil {
+			t.Fatalf("lenient parse failed: %v", err)
+		}
+		// JSON replaces invalid UTF-8 with U+FFFD, which can make two keys
+		// one, so such documents are only checked to read without a panic
+		if !utf8.ValidString(input) {
+			return
+		}
+
+		data, err := p.ParseToonWithOptions(input, DecodeOptions{Strict: true})
+		if verr := p.Validate(strings.NewReader(input)); (err == nil) != (verr == nil) {
+			t.Fatalf("strict parse returned %v but Validate %v", err, verr)
+		}
+		if err != nil {
+			return
+		}
+
+		reformatted, err := p.Reformat(input, EncodeOptions{})
+		if err != nil {
+			t.Fatalf("Reformat: %v", err)
+		}
+		again, err := p.ParseToonWithOptions(reformatted, DecodeOptions{Strict: true})
+		if err != nil {
+			t.Fatalf("reading back\n%s: %v", reformatted, err)
+		}
+		if !sameJSON(again.Value, data.Value, false) {
+			t.Fatalf("Reformat changed %s to %s", mustJSON(data.Value), mustJSON(again.Value))
+		}
+
+		out, err := p.ToonToJSON(input)
+		if err != nil {
+			t.Fatalf("ToonToJSON: %v", err)
+		}
+		want := decodeFixtureJSON(t, json.RawMessage(mustJSON(data.Value)))
+		if value := decodeFixtureJSON(t, json.RawMessage(out)); !sameJSON(value, want, false) {
+			t.Fatalf("ToonToJSON gave %s, ParseToon %s", out, mustJSON(data.Value))
+		}
+
+		doc, err := p.ParseDocument(input)
+		if err != nil {
+			t.Fatalf("ParseDocument: %v", err)
+		}
+		printed, err := p.ParseToon(doc.String())
+		if err != nil || !sameJSON(printed.Value, data.Value, false) {
+			t.Fatalf("the CST printed\n%s\nwhich reads as %s, want %s", doc.String(), mustJSON(printed.Value), mustJSON(data.Value))
+		}
+	})
+}
+
+// FuzzJSONRoundTrip checks that ToonToJSON(JSONToTOON(x)) is x for any JSON
+// document x, up to the order of keys, which a table writes in the order of
+// its header for every row, and the form of numbers, which must keep their
+// value.
+func FuzzJSONRoundTrip(f *testing.F) {
+	for _, file := range loadFixtures(f, "encode") {
+		for _, tc := range file.Tests {
+			f.Add(string(tc.Input))
+		}
+	}
+	f.Add(`{"users":[{"id":1,"name":"Alice"},{"id":2,"name":"Bob"}],"tags":["a","b"]}`)
+
+	p := NewParser()
+	f.Fuzz(func(t *testing.T, input string) {
+		want, err := decodeOrderedJSON([]byte(input))
+		if err != nil {
+			return
+		}
+
+		toon, err := p.JSONToTOON(input)
+		if err != nil {
+			t.Fatalf("JSONToTOON: %v", err)
+		}
+		if _, err := p.ParseToonWithOptions(toon, DecodeOptions{Strict: true}); err != nil {
+			t.Fatalf("JSONToTOON wrote\n%s\nwhich does not parse: %v", toon, err)
+		}
+
+		out, err := p.ToonToJSON(toon)
+		if err != nil {
+			t.Fatalf("ToonToJSON: %v", err)
+		}
+		if got := decodeFixtureJSON(t, json.RawMessage(out)); !sameJSON(got, want, false) {
+			t.Fatalf("round trip of %s through\n%s\ngave %s", input, toon, out)
+		}
+	})
+}
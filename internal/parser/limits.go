@@ -0,0 +1,104 @@
+package parser
+
+import "bytes"
+
+// Limits bounds the resources a document may use while it is read, so that
+// hostile input cannot exhaust the memory of a server. A zero field means no
+// limit.
+//
+// Reading stops at the first limit exceeded, and the document is rejected
+// with a *ParseError whose last diagnostic has ReasonLimitExceeded, even when
+// parsing leniently.
+type Limits struct {
+	// MaxDepth is the deepest nesting of objects and arrays. The root
+	// value is at depth 1.
+	MaxDepth int
+
+	// MaxKeys is the most fields a single object, or the header of a
+	// single table, may have.
+	MaxKeys int
+
+	// MaxArrayLength is the most elements an array may declare in its
+	// header or hold.
+	MaxArrayLength int
+
+	// MaxLineLength is the longest line, in bytes.
+	MaxLineLength int
+
+	// MaxDocumentBytes is the largest document, in bytes.
+	MaxDocumentBytes int
+}
+
+// SetLimits sets the limits applied to the documents read by p. A Parser has
+// no limits until SetLimits is called.
+func (p *Parser) SetLimits(limits Limits) {
+	p.limits = limits
+}
+
+// SetLimits sets the limits applied to the rest of the document.
+func (dec *Decoder) SetLimits(limits Limits) {
+	dec.d.limits = limits
+}
+
+// exceed reports a limit exceeded on line num and stops reading the
+// document.
+func (d *decoder) exceed(num int, format string, args ...interface{}) {
+	d.diagnose(num, 1, ReasonLimitExceeded, format, args...)
+	d.halted = true
+}
+
+// lineFits reports whether n bytes of the current line, read so far, are
+// within the line and document size limits.
+func (d *decoder) lineFits(n int) bool {
+	if max := d.limits.MaxLineLength; max > 0 && n > max+2 {
+		// Allow for the line ending, which measure does not count
+		return false
+	}
+	if max := d.limits.MaxDocumentBytes; max > 0 && d.size+n > max {
+		return false
+	}
+	return true
+}
+
+// measure checks the raw line just read against the line and document size
+// limits.
+func (d *decoder) measure(raw []byte) bool {
+	d.size += len(raw)
+	if max := d.limits.MaxDocumentBytes; max > 0 && d.size > max {
+		d.exceed(d.num, "document is longer than the limit of %d bytes", max)
+		return false
+	}
+	if max := d.limits.MaxLineLength; max > 0 && len(bytes.TrimRight(raw, "\r\n")) > max {
+		d.exceed(d.num, "line is longer than the limit of %d bytes", max)
+		return false
+	}
+	return true
+}
+
+// push opens a container, unless it would nest deeper than the limit.
+func (d *decoder) push(f frame) {
+	if max := d.limits.MaxDepth; max > 0 && len(d.stack) >= max {
+		d.exceed(d.num, "document is nested deeper than the limit of %d levels", max)
+		return
+	}
+	d.stack = append(d.stack, f)
+}
+
+// checkLength reports an array of n elements that is longer than the limit.
+func (d *decoder) checkLength(num, n int) bool {
+	if max := d.limits.MaxArrayLength; max > 0 && n > max {
+		d.exceed(num, "array has %d elements, more than the limit of %d", n, max)
+		return false
+	}
+	return true
+}
+
+// checkKeys reports an object or table header with n fields, more than the
+// limit.
+func (d *decoder) checkKeys(num, n int) bool {
+	if max := d.limits.MaxKeys; max > 0 && n > max {
+		d.exceed(num, "object has %d fields, more than the limit of %d", n, max)
+		return false
+	}
+	return true
+}
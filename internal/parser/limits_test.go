@@ -0,0 +1,134 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestDiagnosticsCapped checks that a document of nothing but errors lists
+// at most maxDiagnostics of them, followed by a count of the rest, and
+// that a limit that stops reading is still the last problem.
+func TestDiagnosticsCapped(t *testing.T) {
+	p := NewParser()
+	doc := strings.Repeat("x\n", 10000)
+
+	err := p.Validate(strings.NewReader(doc))
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected a *ParseError, got %v", err)
+	}
+	diags := parseErr.Diagnostics
+	if len(diags) != maxDiagnostics+1 {
+		t.Fatalf("got %d diagnostics, want %d", len(diags), maxDiagnostics+1)
+	}
+	last := diags[len(diags)-1]
+	if last.Reason != ReasonTooManyProblems || last.Line != maxDiagnostics+1 {
+		t.Fatalf("last diagnostic is %+v", last)
+	}
+	if want := "9900 more problems"; !strings.HasPrefix(last.Message, want) {
+		t.Fatalf("last diagnostic says %q, want it to start with %q", last.Message, want)
+	}
+
+	// Lenient parsing still reads the whole document
+	if _, err := p.ParseToon(doc); err != nil {
+		t.Fatalf("lenient parse failed: %v", err)
+	}
+
+	p.SetLimits(Limits{MaxDocumentBytes: 1000})
+	parseErr, ok = p.Validate(strings.NewReader(doc)).(*ParseError)
+	if !ok {
+		t.Fatal("expected a *ParseError")
+	}
+	diags = parseErr.Diagnostics
+	if n := len(diags); n != maxDiagnostics+2 || diags[n-2].Reason != ReasonTooManyProblems || diags[n-1].Reason != ReasonLimitExceeded {
+		t.Fatalf("got %d diagnostics ending with %+v", n, diags[n-2:])
+	}
+}
+
+// TestLimits checks that each limit rejects a document just past it, on the
+// line where it is exceeded, and accepts one that is just within it.
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		within string
+		past   string
+		line   int
+	}{
+		{
+			name:   "depth",
+			limits: Limits{MaxDepth: 3},
+			within: "a:\n  b:\n    c: 1\n",
+			past:   "a:\n  b:\n    c:\n      d: 1\n",
+			line:   4,
+		},
+		{
+			name:   "depth of list items",
+			limits: Limits{MaxDepth: 2},
+			within: "a[2]:\n  - 1\n  - 2\n",
+			past:   "a[1]:\n  - x: 1\n",
+			line:   2,
+		},
+		{
+			name:   "keys",
+			limits: Limits{MaxKeys: 2},
+			within: "a: 1\nb: 2\n",
+			past:   "x: 0\nn:\n  a: 1\n  b: 2\n  c: 3\n",
+			line:   5,
+		},
+		{
+			name:   "keys of a table header",
+			limits: Limits{MaxKeys: 2},
+			within: "t[1]{a,b}:\n  1,2\n",
+			past:   "t[1]{a,b,c}:\n  1,2,3\n",
+			line:   1,
+		},
+		{
+			name:   "declared array length",
+			limits: Limits{MaxArrayLength: 3},
+			within: "a[3]: 1,2,3\n",
+			past:   "a[4]: 1,2,3,4\n",
+			line:   1,
+		},
+		{
+			name:   "declared table length",
+			limits: Limits{MaxArrayLength: 1},
+			within: "t[1]{a}:\n  1\n",
+			past:   "t[2]{a}:\n  1\n  2\n",
+			line:   1,
+		},
+		{
+			name:   "line length",
+			limits: Limits{MaxLineLength: 10},
+			within: "a: 1234567\r\n",
+			past:   "a: 1\nb: 12345678\n",
+			line:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser()
+			p.SetLimits(tt.limits)
+
+			if err := p.Validate(strings.NewReader(tt.within)); err != nil {
+				t.Fatalf("document within the limit rejected: %v", err)
+			}
+
+			err := p.Validate(strings.NewReader(tt.past))
+			parseErr, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("expected a *ParseError, got %v", err)
+			}
+			last := parseErr.Diagnostics[len(parseErr.Diagnostics)-1]
+			if last.Reason != ReasonLimitExceeded || last.Line != tt.line {
+				t.Fatalf("last diagnostic is %+v, want %s on line %d", last, ReasonLimitExceeded, tt.line)
+			}
+
+			// Lenient parsing stops at a limit too
+			if _, err := p.ParseToon(tt.past); err == nil {
+				t.Fatal("lenient parse accepted a document past the limit")
+			}
+		})
+	}
+}
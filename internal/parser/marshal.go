@@ -0,0 +1,600 @@
+package parser
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+var orderedMapType = reflect.TypeOf((*orderedMap)(nil))
+
+// Marshal returns the TOON encoding of v. Structs and maps with string keys
+// are written as documents of fields; slices and arrays become a root array
+// and anything else a single primitive.
+//
+// Struct fields are encoded under their name, or the name given by a
+// `toon:"name"` tag; a tag of "-" skips the field and the "omitempty" option
+// skips it when it holds a zero value. Fields of embedded structs are
+// promoted into the outer struct. Slices of structs with only primitive
+// fields are written as tabular arrays, and values implementing
+// encoding.TextMarshaler, such as time.Time, are written as strings. A value
+// that holds itself, through a pointer, map or slice, is an error.
+func Marshal(v interface{}) ([]byte, error) {
+	return MarshalWithOptions(v, EncodeOptions{})
+}
+
+// MarshalWithOptions is like Marshal but writes the document with the given
+// options.
+func MarshalWithOptions(v interface{}, opts EncodeOptions) ([]byte, error) {
+	if err := opts.validate(); err != nil {
+		return nil, fmt.Errorf("toon: %v", err)
+	}
+
+	tree, err := marshalValue(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+
+	var result strings.Builder
+	p := &Parser{}
+	p.documentToTOON(&result, tree, opts)
+	return []byte(result.String()), nil
+}
+
+// Unmarshal parses a TOON document and stores the result in the value
+// pointed to by v, following the same field naming rules as Marshal. Field
+// names are matched case-insensitively when there is no exact match.
+// Documents are parsed strictly, so malformed input is reported as a
+// *ParseError.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("toon: Unmarshal requires a non-nil pointer, got %T", v)
+	}
+
+	p := &Parser{}
+	doc, err := p.ParseToonWithOptions(string(data), DecodeOptions{Strict: true})
+	if err != nil {
+		return err
+	}
+
+	return unmarshalValue(rv.Elem(), doc.Value, "")
+}
+
+// structField describes how one Go struct field maps to a TOON key.
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]structField
+
+// typeFields returns the TOON fields of struct type t in declaration order,
+// with the fields of embedded structs promoted. When several fields share a
+// name, the least deeply nested one wins.
+func typeFields(t reflect.Type) []structField {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]structField)
+	}
+
+	var fields []structField
+	depths := make(map[string]int)
+
+	var walk func(t reflect.Type, index []int, depth int)
+	walk = func(t reflect.Type, index []int, depth int) {
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			tag := sf.Tag.Get("toon")
+			if tag == "-" {
+				continue
+			}
+
+			name, opts, _ := strings.Cut(tag, ",")
+			fieldIndex := append(append([]int(nil), index...), i)
+
+			if sf.Anonymous && name == "" {
+				ft := sf.Type
+				if ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					walk(ft, fieldIndex, depth+1)
+					continue
+				}
+			}
+
+			if !sf.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = sf.Name
+			}
+
+			if prev, exists := depths[name]; exists {
+				if prev <= depth {
+					continue
+				}
+				// A shallower field shadows the promoted one
+				for j := range fields {
+					if fields[j].name == name {
+						fields = append(fields[:j], fields[j+1:]...)
+						break
+					}
+				}
+			}
+
+			depths[name] = depth
+			fields = append(fields, structField{
+				name:      name,
+				index:     fieldIndex,
+				omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+			})
+		}
+	}
+	walk(t, nil, 0)
+
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex but reports false instead
+// of panicking when it meets a nil embedded pointer. With alloc set, nil
+// embedded pointers are allocated instead.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// marshalValue converts v into the generic values the encoder works with:
+// *orderedMap, []interface{}, and scalars.
+func marshalValue(v reflect.Value) (interface{}, error) {
+	var m marshaler
+	return m.value(v)
+}
+
+// marshaler tracks the pointers, maps and slices that hold the value being
+// converted, so that a value that holds itself is an error rather than an
+// endless recursion.
+type marshaler struct {
+	holding map[holder]bool
+}
+
+type holder struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// hold records that v, a pointer, map or slice, holds the value being
+// converted until release is called, or returns an error if it already
+// does.
+func (m *marshaler) hold(v reflect.Value) (release func(), err error) {
+	h := holder{ptr: v.Pointer(), typ: v.Type()}
+	if v.Kind() == reflect.Slice {
+		h.len = v.Len()
+	}
+	if m.holding[h] {
+		return nil, fmt.Errorf("toon: encountered a cycle via %s", v.Type())
+	}
+	if m.holding == nil {
+		m.holding = make(map[holder]bool)
+	}
+	m.holding[h] = true
+	return func() { delete(m.holding, h) }, nil
+}
+
+func (m *marshaler) value(v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	// Objects read by ParseOrdered are written as they are
+	if v.Type() == orderedMapType {
+		return v.Interface(), nil
+	}
+
+	// A MarshalText method with a pointer receiver is used when the value
+	// can be addressed, such as a field of a struct marshaled by pointer
+	if v.Kind() != reflect.Pointer && v.CanAddr() && reflect.PointerTo(v.Type()).Implements(textMarshalerType) {
+		v = v.Addr()
+	}
+	if v.Type().Implements(textMarshalerType) {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			return nil, nil
+		}
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return string(text), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Kind() == reflect.Pointer {
+			release, err := m.hold(v)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+		}
+		return m.value(v.Elem())
+	case reflect.Struct:
+		obj := newOrderedMap()
+		for _, f := range typeFields(v.Type()) {
+			fv, ok := fieldByIndex(v, f.index, false)
+			if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+				continue
+			}
+
+			value, err := m.value(fv)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(f.name, value)
+		}
+		return obj, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		release, err := m.hold(v)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		keys := make([]string, 0, v.Len())
+		values := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := marshalMapKey(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := m.value(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+
+			keys = append(keys, key)
+			values[key] = value
+		}
+
+		sort.Strings(keys)
+		return &orderedMap{keys: keys, values: values}, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return base64.StdEncoding.EncodeToString(v.Bytes()), nil
+		}
+		if v.Kind() == reflect.Slice {
+			release, err := m.hold(v)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+		}
+
+		arr := make([]interface{}, v.Len())
+		for i := range arr {
+			item, err := m.value(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = item
+		}
+		return arr, nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	}
+
+	return nil, fmt.Errorf("toon: unsupported type %s", v.Type())
+}
+
+func marshalMapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if k.Type().Implements(textMarshalerType) {
+		text, err := k.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return fmt.Sprint(k.Interface()), nil
+	}
+
+	return "", fmt.Errorf("toon: unsupported map key type %s", k.Type())
+}
+
+// isEmptyValue reports whether v is the zero value omitempty skips.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	case reflect.Struct:
+		return v.IsZero()
+	}
+	return false
+}
+
+// unmarshalValue stores the decoded value src in dst. path names the
+// location in the document for error messages.
+func unmarshalValue(dst reflect.Value, src interface{}, path string) error {
+	if dst.CanAddr() && dst.Addr().Type().Implements(textUnmarshalerType) {
+		if src == nil {
+			dst.Set(reflect.Zero(dst.Type()))
+			return nil
+		}
+		text, ok := src.(string)
+		if !ok {
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+		return dst.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+	}
+
+	switch dst.Kind() {
+	case reflect.Pointer:
+		if src == nil {
+			dst.Set(reflect.Zero(dst.Type()))
+			return nil
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return unmarshalValue(dst.Elem(), src, path)
+	case reflect.Interface:
+		if dst.NumMethod() != 0 {
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+		if src == nil {
+			dst.Set(reflect.Zero(dst.Type()))
+		} else {
+			dst.Set(reflect.ValueOf(src))
+		}
+		return nil
+	}
+
+	if src == nil {
+		// null leaves non-nullable values untouched, as in encoding/json
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Struct:
+		obj, ok := src.(map[string]interface{})
+		if !ok {
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+
+		for _, f := range typeFields(dst.Type()) {
+			value, exists := obj[f.name]
+			if !exists {
+				if value, exists = lookupFold(obj, f.name); !exists {
+					continue
+				}
+			}
+
+			fv, ok := fieldByIndex(dst, f.index, true)
+			if !ok {
+				continue
+			}
+			if err := unmarshalValue(fv, value, joinPath(path, f.name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		obj, ok := src.(map[string]interface{})
+		if !ok || dst.Type().Key().Kind() != reflect.String {
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMapWithSize(dst.Type(), len(obj)))
+		}
+		for key, value := range obj {
+			elem := reflect.New(dst.Type().Elem()).Elem()
+			if err := unmarshalValue(elem, value, joinPath(path, key)); err != nil {
+				return err
+			}
+			dst.SetMapIndex(reflect.ValueOf(key).Convert(dst.Type().Key()), elem)
+		}
+		return nil
+	case reflect.Slice, reflect.Array:
+		if text, ok := src.(string); ok && dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := base64.StdEncoding.DecodeString(text)
+			if err != nil {
+				return fmt.Errorf("toon: invalid base64 at %s: %w", path, err)
+			}
+			dst.SetBytes(b)
+			return nil
+		}
+
+		items, ok := arrayItems(src)
+		if !ok {
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+
+		if dst.Kind() == reflect.Slice {
+			dst.Set(reflect.MakeSlice(dst.Type(), len(items), len(items)))
+		} else if len(items) > dst.Len() {
+			return fmt.Errorf("toon: array of %d values does not fit %s at %s", len(items), dst.Type(), path)
+		}
+
+		for i, item := range items {
+			if err := unmarshalValue(dst.Index(i), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.String:
+		s, ok := src.(string)
+		if !ok {
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+		dst.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+		dst.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := src.(int64)
+		if !ok || dst.OverflowInt(i) {
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+		dst.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch n := src.(type) {
+		case int64:
+			if n < 0 {
+				return unmarshalTypeError(src, dst.Type(), path)
+			}
+			u = uint64(n)
+		case json.Number:
+			var err error
+			if u, err = strconv.ParseUint(n.String(), 10, 64); err != nil {
+				return unmarshalTypeError(src, dst.Type(), path)
+			}
+		default:
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+		if dst.OverflowUint(u) {
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+		dst.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch n := src.(type) {
+		case int64:
+			f = float64(n)
+		case float64:
+			f = n
+		case json.Number:
+			var err error
+			if f, err = n.Float64(); err != nil {
+				return unmarshalTypeError(src, dst.Type(), path)
+			}
+		default:
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+		if dst.OverflowFloat(f) {
+			return unmarshalTypeError(src, dst.Type(), path)
+		}
+		dst.SetFloat(f)
+		return nil
+	}
+
+	return fmt.Errorf("toon: unsupported type %s at %s", dst.Type(), path)
+}
+
+// arrayItems returns the elements of a decoded array in either of the forms
+// the decoder produces.
+func arrayItems(src interface{}) ([]interface{}, bool) {
+	switch arr := src.(type) {
+	case []interface{}:
+		return arr, true
+	case []map[string]interface{}:
+		items := make([]interface{}, len(arr))
+		for i, row := range arr {
+			items[i] = row
+		}
+		return items, true
+	}
+	return nil, false
+}
+
+func lookupFold(obj map[string]interface{}, name string) (interface{}, bool) {
+	for key, value := range obj {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func unmarshalTypeError(src interface{}, t reflect.Type, path string) error {
+	if path == "" {
+		path = "document root"
+	}
+	return fmt.Errorf("toon: cannot unmarshal %s into Go value of type %s at %s", describeValue(src), t, path)
+}
+
+// describeValue names the TOON type of a decoded value.
+func describeValue(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int64, float64, json.Number:
+		return "number"
+	case map[string]interface{}, *orderedMap:
+		return "object"
+	case []interface{}, []map[string]interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,170 @@
+package parser
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Base struct {
+	ID      int    `toon:"id"`
+	Created string `toon:"created,omitempty"`
+}
+
+type Audit struct {
+	By string `toon:"by"`
+	ID string `toon:"id"`
+}
+
+// level has a MarshalText with a pointer receiver.
+type level int
+
+func (l *level) MarshalText() ([]byte, error) {
+	return []byte(strings.Repeat("*", int(*l))), nil
+}
+
+func (l *level) UnmarshalText(text []byte) error {
+	*l = level(len(text))
+	return nil
+}
+
+// point has a MarshalText with a value receiver.
+type point struct{ X, Y int }
+
+func (p point) MarshalText() ([]byte, error) {
+	return []byte(strings.Repeat("+", p.X) + strings.Repeat("-", p.Y)), nil
+}
+
+func (p *point) UnmarshalText(text []byte) error {
+	p.X, p.Y = strings.Count(string(text), "+"), strings.Count(string(text), "-")
+	return nil
+}
+
+type record struct {
+	Base
+	*Audit
+	Name    string         `toon:"name"`
+	Note    string         `toon:",omitempty"`
+	Secret  string         `toon:"-"`
+	Tags    []string       `toon:"tags,omitempty"`
+	When    time.Time      `toon:"when"`
+	Level   level          `toon:"level"`
+	At      point          `toon:"at"`
+	Attrs   map[string]int `toon:"attrs"`
+	Raw     []byte         `toon:"raw"`
+	private int
+}
+
+func TestMarshal(t *testing.T) {
+	r := record{
+		Base:    Base{ID: 7},
+		Audit:   &Audit{By: "ops", ID: "shadowed"},
+		Name:    "Ada",
+		Secret:  "hidden",
+		When:    time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		Level:   3,
+		At:      point{2, 1},
+		Attrs:   map[string]int{"z": 1, "a": 2},
+		Raw:     []byte("hi"),
+		private: 1,
+	}
+
+	// The pointer receiver of level is only reachable through a pointer
+	data, err := Marshal(&r)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	want := "id: 7\n" +
+		"by: ops\n" +
+		"name: Ada\n" +
+		"when: \"2024-05-01T12:30:00Z\"\n" +
+		"level: ***\n" +
+		"at: ++-\n" +
+		"attrs:\n" +
+		"  a: 2\n" +
+		"  z: 1\n" +
+		"raw: aGk=\n"
+	if string(data) != want {
+		t.Fatalf("Marshal gave\n%s\nwant\n%s", data, want)
+	}
+
+	var out record
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	// Secret and private are not written, and of the two id fields the
+	// shallower one wins
+	r.Secret, r.private, r.Audit.ID = "", 0, ""
+	if !reflect.DeepEqual(out, r) {
+		t.Fatalf("Unmarshal gave %+v, want %+v", out, r)
+	}
+}
+
+// node can hold itself.
+type node struct {
+	Name string                 `toon:"name"`
+	Next *node                  `toon:"next"`
+	Data map[string]interface{} `toon:"data"`
+}
+
+func TestMarshalCycles(t *testing.T) {
+	loop := &node{Name: "a"}
+	loop.Next = &node{Name: "b", Next: loop}
+
+	m := map[string]interface{}{}
+	m["self"] = m
+
+	s := []interface{}{nil}
+	s[0] = s
+
+	for name, v := range map[string]interface{}{"pointer": loop, "map": m, "slice": s} {
+		if _, err := Marshal(v); err == nil || !strings.Contains(err.Error(), "cycle") {
+			t.Errorf("Marshal of a %s cycle returned %v", name, err)
+		}
+	}
+
+	// A value that is only shared, not held by itself, is written twice
+	shared := &node{Name: "shared"}
+	data, err := Marshal(map[string]*node{"x": shared, "y": shared})
+	if err != nil {
+		t.Fatalf("Marshal of a shared value: %v", err)
+	}
+	want := "x:\n  name: shared\n  next: null\n  data: null\n" +
+		"y:\n  name: shared\n  next: null\n  data: null\n"
+	if string(data) != want {
+		t.Fatalf("got\n%s\nwant\n%s", data, want)
+	}
+}
+
+// TestMarshalLargeIntegers checks that integers past the range of an int64
+// survive Marshal and Unmarshal exactly.
+func TestMarshalLargeIntegers(t *testing.T) {
+	type numbers struct {
+		Big   uint64  `toon:"big"`
+		Max   uint64  `toon:"max"`
+		Small int64   `toon:"small"`
+		Float float64 `toon:"float"`
+	}
+	in := numbers{Big: math.MaxInt64 + 6, Max: math.MaxUint64, Small: math.MinInt64, Float: 1e20}
+
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var out numbers
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal of\n%s: %v", data, err)
+	}
+	if out != in {
+		t.Fatalf("round trip through\n%s\ngave %+v, want %+v", data, out, in)
+	}
+
+	var small struct {
+		Big int64 `toon:"big"`
+	}
+	if err := Unmarshal(data, &small); err == nil {
+		t.Fatalf("Unmarshal of %d into an int64 succeeded", in.Big)
+	}
+}
@@ -0,0 +1,64 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// NDJSONToTOON converts newline-delimited JSON, one value per line, to a
+// TOON document whose root is an array of the values. Lines of objects with
+// the same primitive fields, as log records usually are, become a table.
+// Blank lines are skipped.
+func (p *Parser) NDJSONToTOON(ndjson string) (string, error) {
+	return p.NDJSONToTOONWithOptions(ndjson, EncodeOptions{})
+}
+
+func (p *Parser) NDJSONToTOONWithOptions(ndjson string, opts EncodeOptions) (string, error) {
+	if err := opts.validate(); err != nil {
+		return "", err
+	}
+
+	records := make([]interface{}, 0)
+	for i, line := range strings.Split(ndjson, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		value, err := decodeOrderedJSON([]byte(line))
+		if err != nil {
+			return "", fmt.Errorf("line %d: %v", i+1, err)
+		}
+		records = append(records, value)
+	}
+
+	var result strings.Builder
+	p.documentToTOON(&result, records, opts)
+	return result.String(), nil
+}
+
+// ToonToNDJSON converts a TOON document whose root is an array, read
+// strictly, to newline-delimited JSON with one element per line. The keys
+// of objects, and the columns of a table, keep their order.
+func (p *Parser) ToonToNDJSON(toon string) (string, error) {
+	data, err := p.decodeOrdered(toon)
+	if err != nil {
+		return "", err
+	}
+
+	items, ok := arrayItems(data)
+	if !ok {
+		return "", fmt.Errorf("the document holds %s, not the root array NDJSON needs", describeValue(data))
+	}
+
+	var result strings.Builder
+	for _, item := range items {
+		line, err := json.Marshal(item)
+		if err != nil {
+			return "", err
+		}
+		result.Write(line)
+		result.WriteByte('\n')
+	}
+	return result.String(), nil
+}
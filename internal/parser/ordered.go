@@ -0,0 +1,159 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// orderedMap is a JSON object that remembers the order of its keys, so the
+// encoder can write them back in the order they were read.
+type orderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedMap() *orderedMap {
+	return &orderedMap{values: make(map[string]interface{})}
+}
+
+func (m *orderedMap) set(key string, value interface{}) {
+	if _, exists := m.values[key]; !exists {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// MarshalJSON writes the object with its keys in order.
+func (m *orderedMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// decodeOrderedJSON parses a JSON document into the same values as
+// json.Unmarshal, except that objects become *orderedMap and numbers are
+// kept as json.Number so they are written back exactly. A number too large
+// for a float64, such as 1e400, is an error, since TOON could only write it
+// as null or a string.
+func decodeOrderedJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	value, err := decodeOrderedValue(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after top-level JSON value")
+	}
+
+	return value, nil
+}
+
+func decodeOrderedValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		obj := newOrderedMap()
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(keyTok.(string), value)
+		}
+
+		// Consume the closing brace
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case json.Delim('['):
+		arr := make([]interface{}, 0)
+		for dec.More() {
+			value, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+
+		// Consume the closing bracket
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return arr, nil
+	}
+
+	if n, ok := tok.(json.Number); ok {
+		if f, err := strconv.ParseFloat(n.String(), 64); err != nil && math.IsInf(f, 0) {
+			return nil, fmt.Errorf("number %s is too large to convert", n)
+		}
+	}
+	return tok, nil
+}
+
+// objectFields returns the keys of an object in the order they should be
+// written, along with its values. Plain maps have no order of their own and
+// are always written sorted. ok is false if v is not an object.
+func objectFields(v interface{}, sortKeys bool) (keys []string, values map[string]interface{}, ok bool) {
+	switch obj := v.(type) {
+	case *orderedMap:
+		keys = obj.keys
+		if sortKeys {
+			keys = append([]string(nil), keys...)
+			sort.Strings(keys)
+		}
+		return keys, obj.values, true
+	case map[string]interface{}:
+		keys = make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys, obj, true
+	}
+
+	return nil, nil, false
+}
+
+// isObject reports whether v is a JSON object in either representation.
+func isObject(v interface{}) bool {
+	switch v.(type) {
+	case *orderedMap, map[string]interface{}:
+		return true
+	}
+	return false
+}
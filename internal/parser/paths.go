@@ -0,0 +1,110 @@
+package parser
+
+import (
+	"sort"
+	"strings"
+)
+
+// pathKey is the key of a field read with DecodeOptions.ExpandPaths, split
+// into the segments of its dotted path. Line and column locate the field for
+// conflict diagnostics; duplicate is set when the key has already been
+// reported as a duplicate.
+type pathKey struct {
+	segments  []string
+	line      int
+	column    int
+	duplicate bool
+}
+
+// splitPath splits a dotted key into its segments, or returns the key whole
+// if any segment is not a plain identifier.
+func splitPath(key string) []string {
+	segments := strings.Split(key, ".")
+	for _, segment := range segments {
+		if !isIdentifier(segment) {
+			return []string{key}
+		}
+	}
+	return segments
+}
+
+// expandPath stores value in obj under the nested objects named by path,
+// creating them as needed and merging with any already there.
+func (d *decoder) expandPath(obj map[string]interface{}, path pathKey, value interface{}) {
+	last := len(path.segments) - 1
+	for i, segment := range path.segments[:last] {
+		child, ok := obj[segment].(map[string]interface{})
+		if !ok {
+			if existing, exists := obj[segment]; exists {
+				d.pathConflict(path, strings.Join(path.segments[:i+1], "."), existing)
+			}
+			child = make(map[string]interface{})
+			obj[segment] = child
+		}
+		obj = child
+	}
+
+	d.mergeField(obj, path, strings.Join(path.segments, "."), path.segments[last], value)
+}
+
+// mergeField sets obj[key] to value, merging the two when both are objects.
+// name is the full dotted name of the field, for diagnostics.
+func (d *decoder) mergeField(obj map[string]interface{}, path pathKey, name, key string, value interface{}) {
+	existing, exists := obj[key]
+	if !exists {
+		obj[key] = value
+		return
+	}
+
+	dst, dstIsObj := existing.(map[string]interface{})
+	src, srcIsObj := value.(map[string]interface{})
+	if !dstIsObj || !srcIsObj {
+		d.pathConflict(path, name, existing)
+		obj[key] = value
+		return
+	}
+
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		d.mergeField(dst, path, name+"."+k, k, src[k])
+	}
+}
+
+func (d *decoder) pathConflict(path pathKey, name string, existing interface{}) {
+	if path.duplicate {
+		return
+	}
+	if _, isObj := existing.(map[string]interface{}); isObj {
+		d.diagnose(path.line, path.column, ReasonPathConflict, "%s is already an object", name)
+		return
+	}
+	d.diagnose(path.line, path.column, ReasonPathConflict, "%s is already set to a value that is not an object", name)
+}
+
+// foldKey follows the chain of single-field objects that starts at the
+// field key: value and returns the dotted key to write and the value at the
+// end of the chain. Keys that are not plain identifiers end the chain, and
+// keys that contain a dot are quoted so they are not expanded when read back.
+func foldKey(key string, value interface{}) (string, interface{}) {
+	if !isIdentifier(key) {
+		if strings.Contains(key, ".") {
+			return quote(key), value
+		}
+		return formatKey(key), value
+	}
+
+	name := key
+	for {
+		keys, values, ok := objectFields(value, false)
+		if !ok || len(keys) != 1 || !isIdentifier(keys[0]) {
+			return name, value
+		}
+		name += "." + keys[0]
+		value = values[keys[0]]
+	}
+}
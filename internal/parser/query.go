@@ -0,0 +1,222 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrPathNotFound is wrapped by the errors Path.Eval returns when the path
+// selects nothing.
+var ErrPathNotFound = errors.New("toon: path not found")
+
+// Path is a compiled path expression selecting part of a decoded document.
+// Fields are named by key and separated by dots, and array elements by
+// index in brackets:
+//
+//	profile.address.city
+//	orders[0].total
+//	orders[-1]         the last order
+//	orders[*].id       the id of every order
+//	"first name"       a key that is quoted because it has a dot, bracket or quote
+//
+// A path that starts with an index selects from a root array.
+type Path struct {
+	expr  string
+	steps []pathStep
+}
+
+type stepKind int
+
+const (
+	stepField stepKind = iota
+	stepIndex
+	stepAll
+)
+
+// pathStep is one field or index of a path. prefix is the text of the path
+// before the step, for error messages.
+type pathStep struct {
+	kind   stepKind
+	key    string
+	index  int
+	prefix string
+}
+
+// CompilePath parses a path expression.
+func CompilePath(expr string) (*Path, error) {
+	p := &Path{expr: expr}
+	if expr == "" {
+		return nil, fmt.Errorf("toon: empty path")
+	}
+
+	for i := 0; i < len(expr); {
+		step := pathStep{prefix: expr[:i]}
+
+		switch {
+		case expr[i] == '[':
+			end := strings.IndexByte(expr[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("toon: invalid path %q: unclosed [ at offset %d", expr, i)
+			}
+			index := expr[i+1 : i+end]
+			if index == "*" {
+				step.kind = stepAll
+			} else {
+				n, err := strconv.Atoi(index)
+				if err != nil {
+					return nil, fmt.Errorf("toon: invalid path %q: bad index [%s]", expr, index)
+				}
+				step.kind = stepIndex
+				step.index = n
+			}
+			i += end + 1
+
+		case i > 0 && expr[i] != '.':
+			return nil, fmt.Errorf("toon: invalid path %q: expected . or [ at offset %d", expr, i)
+
+		default:
+			if i > 0 {
+				// Skip the dot before the key
+				i++
+			}
+			key, n, err := scanPathKey(expr[i:])
+			if err != nil {
+				return nil, fmt.Errorf("toon: invalid path %q: %v at offset %d", expr, err, i)
+			}
+			step.kind = stepField
+			step.key = key
+			i += n
+		}
+
+		p.steps = append(p.steps, step)
+	}
+
+	return p, nil
+}
+
+// scanPathKey reads the key at the start of s, which is either quoted or
+// runs to the next dot or bracket, and returns it with its length in s.
+func scanPathKey(s string) (string, int, error) {
+	if strings.HasPrefix(s, `"`) {
+		end := closingQuote(s)
+		if end < 0 {
+			return "", 0, errors.New("unterminated quoted key")
+		}
+		key, ok := unquote(s[:end+1])
+		if !ok {
+			return "", 0, errors.New("invalid escape in quoted key")
+		}
+		return key, end + 1, nil
+	}
+
+	n := strings.IndexAny(s, ".[]")
+	if n < 0 {
+		n = len(s)
+	}
+	if n == 0 {
+		return "", 0, errors.New("expected a key")
+	}
+	return s[:n], n, nil
+}
+
+// String returns the expression p was compiled from.
+func (p *Path) String() string {
+	return p.expr
+}
+
+// Eval returns the part of a decoded document selected by p. A path with a
+// [*] step returns an array of every value it selects, which may be empty;
+// otherwise Eval returns the single value selected, or an error wrapping
+// ErrPathNotFound if there is none.
+func (p *Path) Eval(value interface{}) (interface{}, error) {
+	nodes := []interface{}{value}
+	all := false
+
+	for _, step := range p.steps {
+		var next []interface{}
+		for _, node := range nodes {
+			switch step.kind {
+			case stepField:
+				if v, ok := fieldValue(node, step.key); ok {
+					next = append(next, v)
+				}
+			case stepIndex:
+				items, _ := arrayItems(node)
+				i := step.index
+				if i < 0 {
+					i += len(items)
+				}
+				if i >= 0 && i < len(items) {
+					next = append(next, items[i])
+				}
+			case stepAll:
+				items, _ := arrayItems(node)
+				next = append(next, items...)
+			}
+		}
+
+		if step.kind == stepAll {
+			all = true
+		}
+		if len(next) == 0 && !all {
+			return nil, notFound(step, nodes[0])
+		}
+		nodes = next
+	}
+
+	if all {
+		if nodes == nil {
+			nodes = []interface{}{}
+		}
+		return nodes, nil
+	}
+	return nodes[0], nil
+}
+
+// fieldValue returns the value of the field key of obj, if obj is an object
+// that has it.
+func fieldValue(obj interface{}, key string) (interface{}, bool) {
+	switch obj := obj.(type) {
+	case map[string]interface{}:
+		v, ok := obj[key]
+		return v, ok
+	case *orderedMap:
+		v, ok := obj.values[key]
+		return v, ok
+	}
+	return nil, false
+}
+
+// notFound describes why step selected nothing from node.
+func notFound(step pathStep, node interface{}) error {
+	name := step.prefix
+	if name == "" {
+		name = "document"
+	}
+
+	switch step.kind {
+	case stepField:
+		if !isObject(node) {
+			return fmt.Errorf("%w: %s holds %s, not an object", ErrPathNotFound, name, describeValue(node))
+		}
+		return fmt.Errorf("%w: %s has no field %q", ErrPathNotFound, name, step.key)
+	default:
+		items, ok := arrayItems(node)
+		if !ok {
+			return fmt.Errorf("%w: %s holds %s, not an array", ErrPathNotFound, name, describeValue(node))
+		}
+		return fmt.Errorf("%w: %s has %d elements, no index %d", ErrPathNotFound, name, len(items), step.index)
+	}
+}
+
+// Select returns the part of the document selected by the path expression
+// expr; see Path.
+func (t *ToonData) Select(expr string) (interface{}, error) {
+	path, err := CompilePath(expr)
+	if err != nil {
+		return nil, err
+	}
+	return path.Eval(t.Value)
+}
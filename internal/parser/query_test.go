@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const pathDocument = `name: shop
+"first name": Ada
+"a.b": dotted
+orders[3]{id,total}:
+  1,10
+  2,20
+  3,30
+groups[2]:
+  - tags[2]: a,b
+  - tags[1]: c
+empty[0]:
+`
+
+func TestPathEval(t *testing.T) {
+	p := NewParser()
+	doc, err := p.ParseToon(pathDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ordered, err := p.ParseOrdered(pathDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		expr, want string
+	}{
+		{"name", `"shop"`},
+		{`"first name"`, `"Ada"`},
+		{`"a.b"`, `"dotted"`},
+		{"orders[0].total", `10`},
+		{"orders[-1]", `{"id":3,"total":30}`},
+		{"orders[-3].id", `1`},
+		{"orders[*].id", `[1,2,3]`},
+		{"groups[*].tags[*]", `["a","b","c"]`},
+		{"groups[*].tags[1]", `["b"]`},
+		{"empty[*]", `[]`},
+		{"orders[*].missing", `[]`},
+	} {
+		for _, value := range []interface{}{doc.Value, ordered} {
+			path, err := CompilePath(tc.expr)
+			if err != nil {
+				t.Fatalf("CompilePath(%q): %v", tc.expr, err)
+			}
+			got, err := path.Eval(value)
+			if err != nil {
+				t.Errorf("%s: %v", tc.expr, err)
+				continue
+			}
+			if mustJSON(got) != tc.want {
+				t.Errorf("%s selected %s, want %s", tc.expr, mustJSON(got), tc.want)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		expr, want string
+	}{
+		{"orders[3]", "orders has 3 elements, no index 3"},
+		{"orders[-4]", "orders has 3 elements, no index -4"},
+		{"missing.key", `document has no field "missing"`},
+		{"name.first", "name holds string, not an object"},
+		{"name[0]", "name holds string, not an array"},
+		{"[0]", "document holds object, not an array"},
+	} {
+		path, err := CompilePath(tc.expr)
+		if err != nil {
+			t.Fatalf("CompilePath(%q): %v", tc.expr, err)
+		}
+		_, err = path.Eval(doc.Value)
+		if !errors.Is(err, ErrPathNotFound) || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s returned %v, want ErrPathNotFound with %q", tc.expr, err, tc.want)
+		}
+	}
+}
+
+func TestCompilePathErrors(t *testing.T) {
+	for _, tc := range []struct {
+		expr, want string
+	}{
+		{"", "empty path"},
+		{"a[", "unclosed ["},
+		{"a[x]", "bad index [x]"},
+		{"a[]", "bad index []"},
+		{"a..b", "expected a key"},
+		{"a.", "expected a key"},
+		{".a", "expected a key"},
+		{"a]", "expected . or [ at offset 1"},
+		{`"a`, "unterminated quoted key"},
+		{`"a\q"`, "invalid escape in quoted key"},
+		{`"a"b`, "expected . or [ at offset 3"},
+	} {
+		if _, err := CompilePath(tc.expr); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("CompilePath(%q) returned %v, want an error containing %q", tc.expr, err, tc.want)
+		}
+	}
+}
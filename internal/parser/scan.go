@@ -0,0 +1,214 @@
+package parser
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// The scanning functions below read the syntax of a single line by hand, in
+// one pass and without allocating, since the decoder runs them on every line
+// of every document it validates.
+
+// arrayHeader is the part of an array field that follows its key: [n]: v1,v2
+// for an inline array or a list, or [n]{f1,f2}: for a table.
+type arrayHeader struct {
+	size  int
+	delim byte
+
+	// table is set for tabular headers, whose field names are in fields.
+	table  bool
+	fields []string
+
+	// rest is whatever follows the colon, trimmed: the values of an inline
+	// array, or nothing for lists and tables.
+	rest string
+}
+
+// scanArrayHeader reads the array header at the start of s. The length may
+// be written as #n, and a tab or | after it declares the delimiter used
+// instead of commas.
+func scanArrayHeader(s string) (arrayHeader, bool) {
+	h := arrayHeader{delim: ','}
+	if len(s) < 4 || s[0] != '[' {
+		return h, false
+	}
+
+	i := 1
+	if s[i] == '#' {
+		i++
+	}
+	start := i
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	if i == start {
+		return h, false
+	}
+	h.size, _ = strconv.Atoi(s[start:i])
+
+	if i < len(s) && (s[i] == '\t' || s[i] == '|') {
+		h.delim = s[i]
+		i++
+	}
+	if i >= len(s) || s[i] != ']' {
+		return h, false
+	}
+	i++
+
+	switch {
+	case i < len(s) && s[i] == '{':
+		// Field names may contain braces when quoted, so the list runs to
+		// the last "}:" on the line
+		end := strings.LastIndex(s[i+1:], "}:")
+		if end < 0 {
+			return h, false
+		}
+		h.table = true
+		h.fields = splitDelimited(s[i+1:i+1+end], h.delim)
+		for j, field := range h.fields {
+			if name, ok := unquote(field); ok {
+				h.fields[j] = name
+			}
+		}
+		h.rest = strings.TrimSpace(s[i+1+end+2:])
+	case i < len(s) && s[i] == ':':
+		h.rest = strings.TrimSpace(s[i+1:])
+	default:
+		return h, false
+	}
+
+	return h, true
+}
+
+// isArrayHeader reports whether s starts with an array header such as [3]:
+// or [2]{a,b}:.
+func isArrayHeader(s string) bool {
+	_, ok := scanArrayHeader(s)
+	return ok
+}
+
+// scanIndent returns the width of the indentation at the start of raw and
+// whether it contains tabs.
+func scanIndent(raw []byte) (indent int, tabs bool) {
+	for indent < len(raw) {
+		switch raw[indent] {
+		case ' ':
+		case '\t':
+			tabs = true
+		default:
+			return indent, tabs
+		}
+		indent++
+	}
+	return indent, tabs
+}
+
+// scanLine splits a raw line into its indentation and its trimmed text,
+// returning false for blank lines and comments, which carry no data.
+func scanLine(raw []byte) (indent int, tabs bool, text []byte, ok bool) {
+	indent, tabs = scanIndent(raw)
+	text = bytes.TrimSpace(raw[indent:])
+	if len(text) == 0 || text[0] == '#' {
+		return 0, false, nil, false
+	}
+	return indent, tabs, text, true
+}
+
+// isNumber reports whether token is a numeric literal a TOON scalar may hold:
+// an optional minus sign, digits without leading zeros, and an optional
+// fraction and exponent. Leading zeros are not allowed, so values such as
+// zip codes stay strings.
+func isNumber(token string) bool {
+	return scanNumber(token, false)
+}
+
+// isNumericLike is broader than isNumber and also accepts leading zeros, as
+// in "007", which other TOON readers may treat as numbers. The encoder
+// quotes strings it accepts.
+func isNumericLike(s string) bool {
+	return scanNumber(s, true)
+}
+
+func scanNumber(s string, leadingZeros bool) bool {
+	i := 0
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+
+	start := i
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	switch {
+	case i == start:
+		return false
+	case !leadingZeros && s[start] == '0' && i-start > 1:
+		return false
+	}
+
+	if i < len(s) && s[i] == '.' {
+		i++
+		if !scanDigits(s, &i) {
+			return false
+		}
+	}
+
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if !scanDigits(s, &i) {
+			return false
+		}
+	}
+
+	return i == len(s)
+}
+
+// scanDigits advances *i past the run of digits in s that starts there,
+// reporting whether there was at least one.
+func scanDigits(s string, i *int) bool {
+	start := *i
+	for *i < len(s) && isDigit(s[*i]) {
+		*i++
+	}
+	return *i > start
+}
+
+// isIdentifier reports whether s is a plain identifier: a letter or
+// underscore followed by letters, digits and underscores.
+func isIdentifier(s string) bool {
+	if s == "" || !isIdentStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isIdentStart(s[i]) && !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isBareKey reports whether key can be written without quotes: an
+// identifier that may also contain dots.
+func isBareKey(key string) bool {
+	if key == "" || !isIdentStart(key[0]) {
+		return false
+	}
+	for i := 1; i < len(key); i++ {
+		if c := key[i]; !isIdentStart(c) && !isDigit(c) && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
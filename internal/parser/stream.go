@@ -0,0 +1,246 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Token holds a value of one of these types:
+//
+//	Delim, for the start and end of objects and arrays
+//	string, for keys and string values
+//	bool, nil, int64 and float64, for other scalar values
+//	json.Number, for integers too large for an int64
+type Token interface{}
+
+// Delim is one of '{', '}', '[' or ']'. Tabular arrays are reported as
+// arrays of objects.
+type Delim rune
+
+func (d Delim) String() string {
+	return string(d)
+}
+
+// Decoder reads a TOON document from an input stream one token at a time.
+// Only the lines needed for the current token are held in memory, so large
+// documents and tables can be processed without loading them whole.
+type Decoder struct {
+	d      *decoder
+	strict bool
+}
+
+// NewDecoder returns a Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{d: newDecoder(r, Limits{})}
+}
+
+// Strict makes the Decoder stop at the first problem in the document and
+// report it as a *ParseError, instead of recovering from it.
+func (dec *Decoder) Strict() {
+	dec.strict = true
+}
+
+// Diagnostics returns the problems found in the document so far.
+func (dec *Decoder) Diagnostics() []Diagnostic {
+	return dec.d.diagnostics()
+}
+
+// Token returns the next token in the document. The first token is
+// Delim('{') for the usual object document, Delim('[') for a root array, or
+// the value of a primitive document. At the end of the document Token
+// returns io.EOF.
+func (dec *Decoder) Token() (Token, error) {
+	ev, err := dec.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch ev.kind {
+	case objectStart:
+		return Delim('{'), nil
+	case objectEnd:
+		return Delim('}'), nil
+	case arrayStart, tableStart:
+		return Delim('['), nil
+	case arrayEnd:
+		return Delim(']'), nil
+	default:
+		return ev.value, nil
+	}
+}
+
+// More reports whether there is another element in the current object or
+// array.
+func (dec *Decoder) More() bool {
+	ev, ok := dec.d.peek()
+	return ok && ev.kind != objectEnd && ev.kind != arrayEnd
+}
+
+// Decode reads the next value from the document and stores it in the value
+// pointed to by v, following the rules of Unmarshal. Called before the first
+// Token, it decodes the whole document; called inside an array, it decodes
+// a single element, such as one row of a tabular array.
+func (dec *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("toon: Decode requires a non-nil pointer, got %T", v)
+	}
+
+	ev, err := dec.next()
+	if err != nil {
+		return err
+	}
+
+	value := dec.d.value(ev)
+	if err := dec.check(); err != nil {
+		return err
+	}
+
+	return unmarshalValue(rv.Elem(), value, "")
+}
+
+func (dec *Decoder) next() (event, error) {
+	ev, ok := dec.d.next()
+	if err := dec.check(); err != nil {
+		return event{}, err
+	}
+	if !ok {
+		return event{}, io.EOF
+	}
+	return ev, nil
+}
+
+// check returns the error that should stop decoding, if any.
+func (dec *Decoder) check() error {
+	if dec.d.err != nil {
+		return dec.d.err
+	}
+	if (dec.strict || dec.d.halted) && len(dec.d.diags) > 0 {
+		return &ParseError{Diagnostics: dec.d.diagnostics()}
+	}
+	return nil
+}
+
+// Validate reads a whole TOON document from r without building it in memory
+// and returns a *ParseError listing every problem found, or nil if the
+// document is well formed.
+func (p *Parser) Validate(r io.Reader) error {
+	d := newDecoder(r, p.limits)
+	d.discard = true
+	d.finish()
+
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.diags) > 0 {
+		return &ParseError{Diagnostics: d.diagnostics()}
+	}
+	return nil
+}
+
+// Encoder writes TOON documents to an output stream.
+type Encoder struct {
+	w     *bufio.Writer
+	p     *Parser
+	opts  EncodeOptions
+	table *tableWriter
+}
+
+// tableWriter tracks a tabular array that is being written row by row.
+type tableWriter struct {
+	fields []string
+	size   int
+	rows   int
+}
+
+// NewEncoder returns an Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w), p: &Parser{}}
+}
+
+// SetOptions sets the options used by later calls to Encode.
+func (enc *Encoder) SetOptions(opts EncodeOptions) {
+	enc.opts = opts
+}
+
+// Encode writes the TOON encoding of v, which must be a struct, a map with
+// string keys, or a pointer to one of those, as top-level fields of the
+// document.
+func (enc *Encoder) Encode(v interface{}) error {
+	if enc.table != nil {
+		return fmt.Errorf("toon: tabular array has %d of %d rows", enc.table.rows, enc.table.size)
+	}
+
+	tree, err := marshalValue(reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	if !isObject(tree) {
+		return fmt.Errorf("toon: cannot encode %T as a document, expected a struct or map", v)
+	}
+	if err := enc.opts.validate(); err != nil {
+		return fmt.Errorf("toon: %v", err)
+	}
+
+	enc.p.mapToTOON(enc.w, tree, 0, enc.opts)
+	return enc.w.Flush()
+}
+
+// EncodeTable starts a top-level tabular array named key with n rows and the
+// given fields. The rows are then written one at a time with EncodeRow, so a
+// large table never has to be held in memory.
+func (enc *Encoder) EncodeTable(key string, n int, fields []string) error {
+	if enc.table != nil {
+		return fmt.Errorf("toon: tabular array has %d of %d rows", enc.table.rows, enc.table.size)
+	}
+	if err := enc.opts.validate(); err != nil {
+		return fmt.Errorf("toon: %v", err)
+	}
+
+	enc.w.WriteString(tableHeader(formatKey(key), n, fields, enc.opts))
+	if n == 0 {
+		return enc.w.Flush()
+	}
+
+	enc.table = &tableWriter{fields: fields, size: n}
+	return nil
+}
+
+// EncodeRow writes the next row of the table started by EncodeTable. It takes
+// one primitive value per field.
+func (enc *Encoder) EncodeRow(values ...interface{}) error {
+	table := enc.table
+	if table == nil {
+		return fmt.Errorf("toon: EncodeRow called without EncodeTable")
+	}
+	if len(values) != len(table.fields) {
+		return fmt.Errorf("toon: row has %d values but the table has %d fields", len(values), len(table.fields))
+	}
+
+	cells := make([]string, len(values))
+	for i, value := range values {
+		cell, err := marshalValue(reflect.ValueOf(value))
+		if err != nil {
+			return err
+		}
+		if _, isArray := cell.([]interface{}); isArray || isObject(cell) {
+			return fmt.Errorf("toon: field %q of a tabular row must be a primitive value", table.fields[i])
+		}
+		cells[i] = formatPrimitive(cell, enc.opts.delimiter())
+	}
+
+	enc.w.WriteString(enc.opts.pad(1))
+	enc.w.WriteString(strings.Join(cells, string(enc.opts.delimiter())))
+	enc.w.WriteString("\n")
+
+	table.rows++
+	if table.rows < table.size {
+		return nil
+	}
+
+	enc.table = nil
+	return enc.w.Flush()
+}
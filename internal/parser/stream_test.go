@@ -0,0 +1,188 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const streamDocument = `name: Ada
+tags[2]: a,b
+rows[2]{id,ok}:
+  1,true
+  2,false
+big: 18446744073709551615
+ratio: 0.5
+none: null
+`
+
+func TestDecoderToken(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(streamDocument))
+	var got []Token
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		got = append(got, tok)
+	}
+
+	want := []Token{
+		Delim('{'),
+		"name", "Ada",
+		"tags", Delim('['), "a", "b", Delim(']'),
+		"rows", Delim('['),
+		Delim('{'), "id", int64(1), "ok", true, Delim('}'),
+		Delim('{'), "id", int64(2), "ok", false, Delim('}'),
+		Delim(']'),
+		"big", json.Number("18446744073709551615"),
+		"ratio", 0.5,
+		"none", nil,
+		Delim('}'),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got tokens\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestDecoderDecodeRows(t *testing.T) {
+	type row struct {
+		ID int  `toon:"id"`
+		OK bool `toon:"ok"`
+	}
+
+	dec := NewDecoder(strings.NewReader(streamDocument))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		if tok == "rows" {
+			break
+		}
+	}
+	if tok, err := dec.Token(); err != nil || tok != Delim('[') {
+		t.Fatalf("got %v, %v, want [", tok, err)
+	}
+
+	var rows []row
+	for dec.More() {
+		var r row
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		rows = append(rows, r)
+	}
+	if want := []row{{1, true}, {2, false}}; !reflect.DeepEqual(rows, want) {
+		t.Fatalf("decoded %v, want %v", rows, want)
+	}
+
+	// The document goes on after the table
+	if tok, err := dec.Token(); err != nil || tok != Delim(']') {
+		t.Fatalf("got %v, %v, want ]", tok, err)
+	}
+	if tok, err := dec.Token(); err != nil || tok != "big" {
+		t.Fatalf("got %v, %v, want big", tok, err)
+	}
+	var big uint64
+	if err := dec.Decode(&big); err != nil || big != 18446744073709551615 {
+		t.Fatalf("decoded %d, %v", big, err)
+	}
+}
+
+func TestDecoderDecodeDocument(t *testing.T) {
+	var doc struct {
+		Name string   `toon:"name"`
+		Tags []string `toon:"tags"`
+		None *int     `toon:"none"`
+	}
+	dec := NewDecoder(strings.NewReader(streamDocument))
+	if err := dec.Decode(&doc); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if doc.Name != "Ada" || !reflect.DeepEqual(doc.Tags, []string{"a", "b"}) || doc.None != nil {
+		t.Fatalf("decoded %+v", doc)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		t.Fatalf("Token after the document returned %v, want io.EOF", err)
+	}
+	if err := dec.Decode(&doc); err != io.EOF {
+		t.Fatalf("Decode after the document returned %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderStrict(t *testing.T) {
+	src := "tags[3]: a,b\nname: Ada\n"
+
+	// Leniently the problem is only noted
+	dec := NewDecoder(strings.NewReader(src))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("lenient Token: %v", err)
+		}
+	}
+	if len(dec.Diagnostics()) != 1 {
+		t.Fatalf("got diagnostics %v", dec.Diagnostics())
+	}
+
+	dec = NewDecoder(strings.NewReader(src))
+	dec.Strict()
+	var err error
+	for err == nil {
+		_, err = dec.Token()
+	}
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Diagnostics[0].Line != 1 {
+		t.Fatalf("strict Token returned %v, want a *ParseError at line 1", err)
+	}
+}
+
+func TestEncoderEncodeTable(t *testing.T) {
+	var b strings.Builder
+	enc := NewEncoder(&b)
+	enc.SetOptions(EncodeOptions{Delimiter: '|'})
+
+	if err := enc.EncodeRow(1); err == nil {
+		t.Fatal("EncodeRow without a table returned no error")
+	}
+	if err := enc.Encode(map[string]interface{}{"name": "log"}); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if err := enc.EncodeTable("rows", 2, []string{"id", "msg"}); err != nil {
+		t.Fatalf("EncodeTable: %v", err)
+	}
+	if err := enc.EncodeRow(1); err == nil {
+		t.Fatal("EncodeRow with too few values returned no error")
+	}
+	if err := enc.EncodeRow(1, []int{1}); err == nil {
+		t.Fatal("EncodeRow with an array value returned no error")
+	}
+	if err := enc.EncodeRow(1, "a|b"); err != nil {
+		t.Fatalf("EncodeRow: %v", err)
+	}
+	if err := enc.Encode(map[string]interface{}{"after": 1}); err == nil {
+		t.Fatal("Encode inside an unfinished table returned no error")
+	}
+	if err := enc.EncodeRow(2, nil); err != nil {
+		t.Fatalf("EncodeRow: %v", err)
+	}
+	if err := enc.EncodeTable("empty", 0, []string{"id"}); err != nil {
+		t.Fatalf("EncodeTable: %v", err)
+	}
+
+	want := "name: log\nrows[2|]{id|msg}:\n  1|\"a|b\"\n  2|null\nempty[0|]{id}:\n"
+	if b.String() != want {
+		t.Fatalf("wrote\n%s\nwant\n%s", b.String(), want)
+	}
+	if _, err := NewParser().ParseToonWithOptions(b.String(), DecodeOptions{Strict: true}); err != nil {
+		t.Fatalf("the document does not read back: %v", err)
+	}
+}
@@ -0,0 +1,363 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// Table edits the rows of a tabular array held by a node of a Document. Rows
+// are numbered from 0, skipping the comments and blank lines between them,
+// and the length in the header is recounted when the document is printed.
+type Table struct {
+	node *Node
+}
+
+// Table returns the tabular array held by the field at path. An empty array
+// is a table with no fields yet, which are taken from the first row
+// appended. It is an error if the field does not exist or holds anything
+// else.
+func (doc *Document) Table(path ...string) (*Table, error) {
+	name := strings.Join(path, ".")
+	n := doc.Field(path...)
+	if n == nil {
+		return nil, fmt.Errorf("toon: no field %s", name)
+	}
+
+	h := n.Header
+	if h == nil || (h.Fields == nil && (len(n.Values) > 0 || len(n.Children) > 0)) {
+		return nil, fmt.Errorf("toon: field %s is not a tabular array", name)
+	}
+	return &Table{node: n}, nil
+}
+
+// Fields returns the names of the columns.
+func (t *Table) Fields() []string {
+	return t.node.Header.Fields
+}
+
+// Len returns the number of rows.
+func (t *Table) Len() int {
+	return len(t.rows())
+}
+
+func (t *Table) rows() []*Node {
+	var rows []*Node
+	for _, n := range t.node.Children {
+		if n.Kind == RowNode {
+			rows = append(rows, n)
+		}
+	}
+	return rows
+}
+
+// row returns row i, or an error if there is none.
+func (t *Table) row(i int) (*Node, error) {
+	rows := t.rows()
+	if i < 0 || i >= len(rows) {
+		return nil, fmt.Errorf("toon: row %d is out of range, the table has %d rows", i, len(rows))
+	}
+	return rows[i], nil
+}
+
+// Row returns row i as a map from field name to value, decoded as by
+// ParseToon.
+func (t *Table) Row(i int) (map[string]interface{}, error) {
+	row, err := t.row(i)
+	if err != nil {
+		return nil, err
+	}
+	return t.values(row), nil
+}
+
+func (t *Table) values(row *Node) map[string]interface{} {
+	values := make(map[string]interface{}, len(t.node.Header.Fields))
+	for j, field := range t.node.Header.Fields {
+		if j < len(row.Values) {
+			values[field] = parsePrimitive(row.Values[j])
+		}
+	}
+	return values
+}
+
+// Append adds a row at the end of the table. The row must have a primitive
+// value for every field of the table and no other fields. Appending to an
+// empty array sets its fields to the keys of the row, in sorted order.
+func (t *Table) Append(row map[string]interface{}) error {
+	h := t.node.Header
+	if h.Fields == nil {
+		fields := make([]string, 0, len(row))
+		for field := range row {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		h.Fields = fields
+	}
+
+	for field := range row {
+		if !t.hasField(field) {
+			return fmt.Errorf("toon: table has no field %q", field)
+		}
+	}
+
+	tokens := make([]string, len(h.Fields))
+	for i, field := range h.Fields {
+		value, ok := row[field]
+		if !ok {
+			return fmt.Errorf("toon: row is missing field %q", field)
+		}
+		token, err := rowToken(field, value)
+		if err != nil {
+			return err
+		}
+		tokens[i] = token
+	}
+
+	t.node.Children = append(t.node.Children, &Node{Kind: RowNode, Values: tokens})
+	return nil
+}
+
+// Update sets fields of row i to the values in set, which must all be
+// fields of the table.
+func (t *Table) Update(i int, set map[string]interface{}) error {
+	row, err := t.row(i)
+	if err != nil {
+		return err
+	}
+	return t.update(row, set)
+}
+
+// UpdateFunc calls update with the index and value of each row, in order,
+// and sets the fields of the row to the values it returns, if any. It
+// returns how many rows it changed.
+func (t *Table) UpdateFunc(update func(i int, row map[string]interface{}) map[string]interface{}) (int, error) {
+	updated := 0
+	for i, row := range t.rows() {
+		set := update(i, t.values(row))
+		if set == nil {
+			continue
+		}
+		if err := t.update(row, set); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+func (t *Table) update(row *Node, set map[string]interface{}) error {
+	for field, value := range set {
+		j := t.fieldIndex(field)
+		if j < 0 {
+			return fmt.Errorf("toon: table has no field %q", field)
+		}
+		token, err := rowToken(field, value)
+		if err != nil {
+			return err
+		}
+		for len(row.Values) <= j {
+			row.Values = append(row.Values, "null")
+		}
+		row.Values[j] = token
+	}
+	return nil
+}
+
+// RemoveFunc removes the rows for which remove returns true and returns how
+// many it removed. remove is called with the index and value of each row, in
+// order, before any row is removed.
+func (t *Table) RemoveFunc(remove func(i int, row map[string]interface{}) bool) int {
+	drop := make(map[*Node]bool)
+	for i, row := range t.rows() {
+		if remove(i, t.values(row)) {
+			drop[row] = true
+		}
+	}
+
+	kept := t.node.Children[:0]
+	for _, n := range t.node.Children {
+		if !drop[n] {
+			kept = append(kept, n)
+		}
+	}
+	t.node.Children = kept
+	return len(drop)
+}
+
+func (t *Table) hasField(field string) bool {
+	return t.fieldIndex(field) >= 0
+}
+
+func (t *Table) fieldIndex(field string) int {
+	for i, f := range t.node.Header.Fields {
+		if f == field {
+			return i
+		}
+	}
+	return -1
+}
+
+// rowToken formats the value of a cell, which must be a primitive.
+func rowToken(field string, value interface{}) (string, error) {
+	if _, isArray := arrayItems(value); isArray || isObject(value) {
+		return "", fmt.Errorf("toon: field %q of a tabular row must be a primitive value", field)
+	}
+	return formatPrimitive(value, 0), nil
+}
+
+// Condition is a test on one field of a row, such as status=shipped or
+// total>100.
+type Condition struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+// conditionOps are the operators of a Condition, longest first so that <=
+// is not read as <.
+var conditionOps = []string{"!=", "<=", ">=", "=", "<", ">"}
+
+// ParseCondition parses a condition of the form field op value, where op is
+// one of =, !=, <, <=, > or >=. The value is read as a TOON primitive, so
+// id=7 matches the number 7 and id="7" the string.
+func ParseCondition(expr string) (Condition, error) {
+	i := strings.IndexAny(expr, "!<>=")
+	if i < 0 {
+		return Condition{}, fmt.Errorf("toon: invalid condition %q, expected field, operator and value", expr)
+	}
+
+	c := Condition{Field: strings.TrimSpace(expr[:i])}
+	for _, op := range conditionOps {
+		if strings.HasPrefix(expr[i:], op) {
+			c.Op = op
+			break
+		}
+	}
+	if c.Field == "" || c.Op == "" {
+		return Condition{}, fmt.Errorf("toon: invalid condition %q, expected field, operator and value", expr)
+	}
+
+	token := strings.TrimSpace(expr[i+len(c.Op):])
+	if token == "" {
+		return Condition{}, fmt.Errorf("toon: invalid condition %q, missing value", expr)
+	}
+	c.Value = parsePrimitive(token)
+	return c, nil
+}
+
+// Match reports whether row satisfies c. Ordering comparisons apply to two
+// numbers or two strings and are false for anything else.
+func (c Condition) Match(row map[string]interface{}) bool {
+	value, ok := row[c.Field]
+	if !ok {
+		return false
+	}
+
+	cmp, comparable := compareValues(value, c.Value)
+	switch c.Op {
+	case "=":
+		return comparable && cmp == 0
+	case "!=":
+		return !comparable || cmp != 0
+	case "<":
+		return comparable && cmp < 0 && ordered(value)
+	case "<=":
+		return comparable && cmp <= 0 && ordered(value)
+	case ">":
+		return comparable && cmp > 0 && ordered(value)
+	case ">=":
+		return comparable && cmp >= 0 && ordered(value)
+	}
+	return false
+}
+
+// compareValues compares two primitives of the same type, treating all
+// numbers as one type. comparable is false if they are of different types.
+func compareValues(a, b interface{}) (cmp int, comparable bool) {
+	// Integers are compared exactly, since as float64 those past 2^53 are
+	// equal to their neighbours
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if x, ok := toInteger(a); ok {
+		if y, ok := toInteger(b); ok {
+			return x.Cmp(y), true
+		}
+	}
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case bool:
+		y, ok := b.(bool)
+		if !ok || x != y {
+			return 1, ok
+		}
+		return 0, true
+	case nil:
+		return 0, b == nil
+	}
+	return 0, false
+}
+
+// ordered reports whether v is a number or string, the values that have an
+// order.
+func ordered(v interface{}) bool {
+	if _, ok := toFloat(v); ok {
+		return true
+	}
+	_, ok := v.(string)
+	return ok
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// toInteger returns v as an integer if it is an int64, or a json.Number
+// written as one.
+func toInteger(v interface{}) (*big.Int, bool) {
+	switch n := v.(type) {
+	case int64:
+		return big.NewInt(n), true
+	case json.Number:
+		return new(big.Int).SetString(n.String(), 10)
+	}
+	return nil, false
+}
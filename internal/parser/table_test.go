@@ -0,0 +1,94 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTableUpdate(t *testing.T) {
+	p := NewParser()
+	doc, err := p.ParseDocument("orders[3]{id,status}:\n  1,new\n  # shipped today\n  2,new\n  3,paid\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := doc.Table("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := table.UpdateFunc(func(i int, row map[string]interface{}) map[string]interface{} {
+		if row["status"] != "new" {
+			return nil
+		}
+		return map[string]interface{}{"status": "shipped"}
+	})
+	if err != nil || updated != 2 {
+		t.Fatalf("UpdateFunc updated %d rows, %v", updated, err)
+	}
+	if err := table.Update(2, map[string]interface{}{"status": nil}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	want := "orders[3]{id,status}:\n  1,shipped\n  # shipped today\n  2,shipped\n  3,null\n"
+	if got := doc.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+
+	row, err := table.Row(1)
+	if err != nil || row["id"] != int64(2) {
+		t.Fatalf("Row(1) = %v, %v", row, err)
+	}
+	for _, i := range []int{-1, 3} {
+		if _, err := table.Row(i); err == nil {
+			t.Errorf("Row(%d) returned no error", i)
+		}
+		if err := table.Update(i, map[string]interface{}{"status": "x"}); err == nil {
+			t.Errorf("Update(%d) returned no error", i)
+		}
+	}
+	if _, err := table.UpdateFunc(func(int, map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"missing": 1}
+	}); err == nil {
+		t.Error("UpdateFunc set a field the table does not have")
+	}
+}
+
+func TestConditionIntegers(t *testing.T) {
+	p := NewParser()
+	doc, err := p.ParseDocument("rows[4]{id}:\n  9007199254740992\n  9007199254740993\n  18446744073709551615\n  18446744073709551614\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := doc.Table("rows")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		expr string
+		want []int
+	}{
+		{"id=9007199254740993", []int{1}},
+		{"id<9007199254740993", []int{0}},
+		{"id=18446744073709551615", []int{2}},
+		{"id>18446744073709551614", []int{2}},
+		{"id>=9007199254740993", []int{1, 2, 3}},
+	} {
+		c, err := ParseCondition(tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for i := 0; i < table.Len(); i++ {
+			row, err := table.Row(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Match(row) {
+				got = append(got, i)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s matched rows %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
@@ -1,152 +1,986 @@
 package parser
 
 import (
+        "bufio"
         "encoding/json"
+        "errors"
         "fmt"
-        "regexp"
+        "io"
+        "math"
+        "sort"
         "strconv"
         "strings"
 )
 
-type Parser struct{}
+type Parser struct {
+        limits Limits
+}
 
 func NewParser() *Parser {
         return &Parser{}
 }
 
+// DecodeOptions controls how ParseToonWithOptions reads a document.
+type DecodeOptions struct {
+        // Strict rejects any document with problems, such as a length
+        // mismatch or bad indentation, returning a *ParseError that lists
+        // them all. Otherwise the parser recovers as best it can, which keeps
+        // documents written by older versions readable.
+        Strict bool
+
+        // ExpandPaths splits unquoted dotted keys such as a.b.c into nested
+        // objects, undoing EncodeOptions.FoldKeys. Only keys whose segments
+        // are all plain identifiers are split; quoted keys are always kept
+        // as they are. Fields that land on the same object are merged, and a
+        // path that runs into a value that is not an object is a conflict:
+        // strict parsing reports it, otherwise the later field wins.
+        ExpandPaths bool
+
+        // Indent is the number of spaces per nesting level, 2 by default. It
+        // must match the EncodeOptions.Indent the document was written with.
+        Indent int
+}
+
+// EncodeOptions controls how JSONToTOONWithOptions writes a document. The
+// zero value gives the standard layout.
+type EncodeOptions struct {
+        // Indent is the number of spaces per nesting level, 2 by default.
+        // Readers of a document written with another width need the same
+        // DecodeOptions.Indent.
+        Indent int
+
+        // LengthMarker writes array lengths as [#3] rather than [3], which
+        // some models read more reliably as a count.
+        LengthMarker bool
+
+        // SortKeys writes object keys in sorted order, a canonical form that
+        // does not depend on the input. By default keys keep the order they
+        // have in the input JSON.
+        SortKeys bool
+
+        // Delimiter separates the values of inline arrays and tabular rows:
+        // ',' (the default), '\t' or '|'. Any other delimiter is declared in
+        // the array header, as in tags[3|]: a|b|c, so readers know how to
+        // split the values.
+        Delimiter byte
+
+        // FoldKeys writes chains of objects that each have a single field as
+        // one dotted key, so a: {b: {c: 1}} becomes a.b.c: 1. Only keys that
+        // are plain identifiers are folded, and keys that contain a dot are
+        // quoted, so that DecodeOptions.ExpandPaths reads back the same
+        // document.
+        FoldKeys bool
+
+        // TabularThreshold is the fewest rows an array of uniform objects
+        // needs to be written as a table; smaller ones are written as lists.
+        // Zero or one always uses tables.
+        TabularThreshold int
+
+        // MaxLineWidth is the longest line an inline array or a table row may
+        // take. Arrays that would need longer lines are written as lists,
+        // one item per line, instead. Zero means no limit. Single values are
+        // never wrapped, so they may still exceed it.
+        MaxLineWidth int
+}
+
+// MaxIndent and MaxLineWidth bound the Indent and MaxLineWidth of
+// EncodeOptions, so that options taken from a request cannot make the
+// encoder pad lines with more spaces than the document holds values.
+const (
+        MaxIndent    = 16
+        MaxLineWidth = 1 << 16
+)
+
+// delimiter returns the delimiter to write, defaulting to a comma.
+func (o EncodeOptions) delimiter() byte {
+        if o.Delimiter == 0 {
+                return ','
+        }
+        return o.Delimiter
+}
+
+// pad returns the indentation of a line at the given nesting level.
+func (o EncodeOptions) pad(level int) string {
+        width := o.Indent
+        if width == 0 {
+                width = indentSize
+        }
+        return strings.Repeat(" ", level*width)
+}
+
+// length writes the length of an array as it appears in its header.
+func (o EncodeOptions) length(n int) string {
+        if o.LengthMarker {
+                return "#" + strconv.Itoa(n)
+        }
+        return strconv.Itoa(n)
+}
+
+// fits reports whether a line at the given nesting level with text on it is
+// within MaxLineWidth.
+func (o EncodeOptions) fits(level int, text string) bool {
+        return o.MaxLineWidth <= 0 || len(o.pad(level))+len(text) <= o.MaxLineWidth
+}
+
+// validate reports options that cannot produce a readable document.
+func (o EncodeOptions) validate() error {
+        if !validDelimiter(o.delimiter()) {
+                return fmt.Errorf("unsupported delimiter %q", o.Delimiter)
+        }
+        if o.Indent < 0 || o.Indent > MaxIndent {
+                return fmt.Errorf("invalid indent width %d, expected at most %d", o.Indent, MaxIndent)
+        }
+        if o.MaxLineWidth < 0 || o.MaxLineWidth > MaxLineWidth {
+                return fmt.Errorf("invalid line width %d, expected at most %d", o.MaxLineWidth, MaxLineWidth)
+        }
+        return nil
+}
+
+// validDelimiter reports whether delim is one of the delimiters TOON allows.
+func validDelimiter(delim byte) bool {
+        return delim == ',' || delim == '\t' || delim == '|'
+}
+
 type ToonData struct {
         Fields map[string]interface{}
+
+        // Value is the whole document. For the usual object document it is
+        // the same map as Fields; a document may also be a single array with
+        // no key, or a single primitive, in which case Fields is nil.
+        Value interface{}
 }
 
-func (p *Parser) ParseToon(toon string) (*ToonData, error) {
-        data := &ToonData{
-                Fields: make(map[string]interface{}),
+// indentSize is the default number of spaces per nesting level.
+const indentSize = 2
+
+// line is a significant (non-blank, non-comment) line of a TOON document.
+type line struct {
+        num    int
+        indent int
+        text   string
+}
+
+type eventKind int
+
+const (
+        objectStart eventKind = iota
+        objectEnd
+        arrayStart
+        tableStart
+        arrayEnd
+        keyEvent
+        valueEvent
+)
+
+// event is a single structural element produced by the decoder. Keys and
+// scalar values carry their content in value.
+type event struct {
+        kind  eventKind
+        value interface{}
+}
+
+type frameKind int
+
+const (
+        objectFrame frameKind = iota
+        tableFrame
+        listFrame
+)
+
+// frame is an open container on the decoder's indentation stack. The fields
+// of an object all sit at indent; the rows of a table and the items of a list
+// are the lines indented deeper than their header, which sits at indent.
+type frame struct {
+        kind   frameKind
+        indent int
+        line   int
+        keys   map[string]bool
+        width  int
+        fields []interface{}
+        delim  byte
+        size   int
+        rows   int
+}
+
+// decoder turns TOON lines into a stream of events. Nesting is tracked with
+// an explicit indentation stack, so documents of any depth are supported.
+// Lines are read from the input only as they are needed, so memory use is
+// bounded by the nesting depth rather than the size of the document.
+type decoder struct {
+        r       *bufio.Reader
+        long    []byte
+        num     int
+        size    int
+        pending line
+        peeked  bool
+        eof     bool
+        err     error
+        started bool
+        expand  bool
+        indent  int
+
+        // discard skips building scalar values when only the shape of the
+        // document is checked, as in Validate.
+        discard bool
+
+        limits Limits
+        halted bool
+
+        stack []frame
+        queue []event
+        head  int
+        diags []Diagnostic
+        // unreported counts the problems found after maxDiagnostics, from
+        // line unreportedLine on.
+        unreported     int
+        unreportedLine int
+}
+
+func newDecoder(r io.Reader, limits Limits) *decoder {
+        return &decoder{r: bufio.NewReader(r), indent: indentSize, limits: limits}
+}
+
+// start opens the root value. Most documents are objects, but a document may
+// also be a single array header with no key, such as [2]{id,name}:, or a
+// single line holding a primitive.
+func (d *decoder) start() {
+        d.started = true
+
+        ln, ok := d.peekLine()
+        if ok && strings.HasPrefix(ln.text, "[") && isArrayHeader(ln.text) {
+                d.nextLine()
+                d.array(ln, ln.text)
+                return
         }
 
-        lines := strings.Split(toon, "\n")
-        var currentObject map[string]interface{}
-        var currentArray []interface{}
-        var inArray bool
-        var inObject bool
+        // The document itself is the root object
+        d.push(frame{kind: objectFrame, indent: 0, keys: make(map[string]bool)})
+        d.emit(objectStart, nil)
+
+        if !ok {
+                return
+        }
+        if _, rest, isField := splitKey(ln.text); isField && rest != "" {
+                return
+        }
+
+        d.nextLine()
+        if _, more := d.peekLine(); !more {
+                d.stack = d.stack[:0]
+                d.queue = d.queue[:0]
+                d.emit(valueEvent, d.scalar(ln, ln.text))
+                return
+        }
+
+        // Several lines make an object, in which this one is missing its key
+        d.field(ln)
+}
 
-        for _, line := range lines {
-                line = strings.TrimSpace(line)
-                if line == "" || strings.HasPrefix(line, "#") {
+// trailing reports any lines left once a root array or primitive is
+// complete, as nothing may follow it.
+func (d *decoder) trailing() {
+        ln, ok := d.peekLine()
+        if !ok {
+                return
+        }
+
+        d.diagnose(ln.num, ln.indent+1, ReasonSyntax, "unexpected content after the root value")
+        for ok {
+                d.nextLine()
+                _, ok = d.peekLine()
+        }
+}
+
+// peekLine returns the next significant line without consuming it.
+func (d *decoder) peekLine() (line, bool) {
+        for !d.peeked && !d.eof && !d.halted {
+                raw, err := d.r.ReadSlice('\n')
+                if err == bufio.ErrBufferFull {
+                        // Lines longer than the reader's buffer are collected in
+                        // pieces, stopping once they are over the limits
+                        d.long = append(d.long[:0], raw...)
+                        for err == bufio.ErrBufferFull && d.lineFits(len(d.long)) {
+                                raw, err = d.r.ReadSlice('\n')
+                                d.long = append(d.long, raw...)
+                        }
+                        raw = d.long
+                }
+                if err != nil && err != bufio.ErrBufferFull {
+                        d.eof = true
+                        if err != io.EOF {
+                                d.err = err
+                        }
+                }
+                if len(raw) == 0 {
                         continue
                 }
+                d.num++
 
-                // Handle array syntax: key[n]: value1,value2,value3
-                if arrayMatch := regexp.MustCompile(`^([^\[]+)\[(\d+)\]:\s*(.+)$`).FindStringSubmatch(line); arrayMatch != nil {
-                        key := arrayMatch[1]
-                        size, _ := strconv.Atoi(arrayMatch[2])
-                        values := strings.Split(arrayMatch[3], ",")
-                        
-                        // Trim whitespace from each value
-                        for i, val := range values {
-                                values[i] = strings.TrimSpace(val)
-                        }
-                        
-                        // Ensure we don't exceed the specified size
-                        if len(values) > size {
-                                values = values[:size]
+                if !d.measure(raw) {
+                        break
+                }
+
+                indent, tabs, text, ok := scanLine(raw)
+                if !ok {
+                        continue
+                }
+
+                if tabs {
+                        d.diagnose(d.num, 1, ReasonBadIndentation, "tabs are not allowed in indentation")
+                } else if indent%d.indent != 0 {
+                        d.diagnose(d.num, 1, ReasonBadIndentation, "indentation of %d spaces is not a multiple of %d", indent, d.indent)
+                }
+
+                d.pending = line{num: d.num, indent: indent, text: string(text)}
+                d.peeked = true
+        }
+
+        return d.pending, d.peeked
+}
+
+// nextLine consumes the line returned by peekLine.
+func (d *decoder) nextLine() line {
+        d.peeked = false
+        return d.pending
+}
+
+func (d *decoder) emit(kind eventKind, value interface{}) {
+        d.queue = append(d.queue, event{kind: kind, value: value})
+}
+
+// emitKey emits the key of a field of the innermost open object.
+func (d *decoder) emitKey(key string, ln line) {
+        var path pathKey
+        if d.expand {
+                path = pathKey{segments: []string{key}, line: ln.num, column: ln.indent + 1}
+                if !strings.HasPrefix(ln.text, `"`) {
+                        path.segments = splitPath(key)
+                }
+        }
+
+        top := &d.stack[len(d.stack)-1]
+        top.width++
+        if !d.checkKeys(ln.num, top.width) {
+                return
+        }
+
+        // Dotted paths are checked for conflicts as they are expanded
+        if len(path.segments) < 2 {
+                if top.keys[key] {
+                        d.diagnose(ln.num, ln.indent+1, ReasonDuplicateKey, "duplicate key %q", key)
+                        path.duplicate = true
+                }
+                top.keys[key] = true
+        }
+
+        if d.expand {
+                d.emit(keyEvent, path)
+                return
+        }
+        d.emit(keyEvent, key)
+}
+
+// maxDiagnostics is the most problems listed for a document. Past it they
+// are only counted, so that a document of nothing but errors cannot fill
+// the memory of a server, or a response, with diagnostics.
+const maxDiagnostics = 100
+
+// diagnose records a problem with the document. Decoding always carries on,
+// so lenient callers still get a best-effort result.
+func (d *decoder) diagnose(num, col int, reason Reason, format string, args ...interface{}) {
+        if n := len(d.diags); n > 0 && d.diags[n-1].Line == num && d.diags[n-1].Reason == reason {
+                // One diagnostic per line and reason is enough
+                return
+        }
+        if len(d.diags) >= maxDiagnostics && reason != ReasonLimitExceeded {
+                if d.unreported == 0 {
+                        d.unreportedLine = num
+                }
+                d.unreported++
+                return
+        }
+
+        d.diags = append(d.diags, Diagnostic{
+                Line:    num,
+                Column:  col,
+                Reason:  reason,
+                Message: fmt.Sprintf(format, args...),
+        })
+}
+
+// diagnostics returns the recorded problems in document order.
+func (d *decoder) diagnostics() []Diagnostic {
+        sort.SliceStable(d.diags, func(i, j int) bool {
+                if d.diags[i].Line != d.diags[j].Line {
+                        return d.diags[i].Line < d.diags[j].Line
+                }
+                return d.diags[i].Column < d.diags[j].Column
+        })
+        if d.unreported == 0 {
+                return d.diags
+        }
+
+        diags := append([]Diagnostic(nil), d.diags...)
+        more := Diagnostic{
+                Line:    d.unreportedLine,
+                Column:  1,
+                Reason:  ReasonTooManyProblems,
+                Message: fmt.Sprintf("%d more problems from here on are not listed", d.unreported),
+        }
+        // A limit that stopped reading stays the last problem
+        if n := len(diags); diags[n-1].Reason == ReasonLimitExceeded {
+                return append(diags[:n-1], more, diags[n-1])
+        }
+        return append(diags, more)
+}
+
+// scalar decodes a value token found on ln, reporting malformed quoted
+// strings.
+func (d *decoder) scalar(ln line, token string) interface{} {
+        if strings.HasPrefix(token, `"`) {
+                if _, ok := unquote(token); !ok {
+                        col := ln.indent + strings.Index(ln.text, token) + 1
+                        if closingQuote(token) == len(token)-1 {
+                                d.diagnose(ln.num, col, ReasonBadEscape, "invalid escape sequence in %s", token)
+                        } else {
+                                d.diagnose(ln.num, col, ReasonSyntax, "malformed quoted string %s", token)
                         }
-                        
-                        data.Fields[key] = values
+                }
+        }
+        if d.discard {
+                return nil
+        }
+        return parsePrimitive(token)
+}
+
+// peek returns the next event without consuming it, or false once the
+// document is exhausted.
+func (d *decoder) peek() (event, bool) {
+        for len(d.queue) == 0 && !d.halted {
+                if !d.started {
+                        d.start()
                         continue
                 }
+                if len(d.stack) == 0 {
+                        d.trailing()
+                        return event{}, false
+                }
+                d.step()
+        }
+
+        if d.halted {
+                // Nothing more is read once a limit is exceeded
+                return event{}, false
+        }
+        return d.queue[d.head], true
+}
 
-                // Handle object array syntax: key[n]{fields}: data
-                if objectArrayMatch := regexp.MustCompile(`^([^\[]+)\[(\d+)\]\{([^\}]+)\}:\s*(.+)$`).FindStringSubmatch(line); objectArrayMatch != nil {
-                        key := objectArrayMatch[1]
-                        size, _ := strconv.Atoi(objectArrayMatch[2])
-                        fields := strings.Split(objectArrayMatch[3], ",")
-                        dataLines := strings.Split(objectArrayMatch[4], "\n")
-                        
-                        objects := make([]map[string]interface{}, 0)
-                        
-                        for _, dataLine := range dataLines {
-                                dataLine = strings.TrimSpace(dataLine)
-                                if dataLine == "" {
-                                        continue
-                                }
-                                
-                                values := strings.Split(dataLine, ",")
-                                if len(values) == len(fields) {
-                                        obj := make(map[string]interface{})
-                                        for i, field := range fields {
-                                                obj[strings.TrimSpace(field)] = strings.TrimSpace(values[i])
-                                        }
-                                        objects = append(objects, obj)
-                                }
+// next returns the next event, or false once the document is exhausted.
+func (d *decoder) next() (event, bool) {
+        ev, ok := d.peek()
+        if ok {
+                d.head++
+                if d.head == len(d.queue) {
+                        // Reuse the queue once it is drained
+                        d.queue = d.queue[:0]
+                        d.head = 0
+                }
+        }
+        return ev, ok
+}
+
+// step consumes one line for the innermost open container, or closes it
+// when the next line is indented too little to belong to it.
+func (d *decoder) step() {
+        top := &d.stack[len(d.stack)-1]
+        ln, ok := d.peekLine()
+        if d.halted {
+                return
+        }
+
+        if top.kind == tableFrame {
+                if !ok || ln.indent <= top.indent {
+                        if top.rows != top.size {
+                                d.diagnose(top.line, top.indent+1, ReasonLengthMismatch, "tabular array declares %d rows but has %d", top.size, top.rows)
+                        }
+                        d.stack = d.stack[:len(d.stack)-1]
+                        d.emit(arrayEnd, nil)
+                        return
+                }
+
+                d.nextLine()
+                top.rows++
+                if !d.checkLength(ln.num, top.rows) {
+                        return
+                }
+                if ln.indent != top.indent+d.indent {
+                        d.diagnose(ln.num, 1, ReasonBadIndentation, "row should be indented %d spaces, found %d", top.indent+d.indent, ln.indent)
+                }
+                d.row(ln, top.fields, top.delim)
+                return
+        }
+
+        if top.kind == listFrame {
+                if !ok || ln.indent <= top.indent {
+                        if top.rows != top.size {
+                                d.diagnose(top.line, top.indent+1, ReasonLengthMismatch, "list declares %d items but has %d", top.size, top.rows)
                         }
-                        
+                        d.stack = d.stack[:len(d.stack)-1]
+                        d.emit(arrayEnd, nil)
+                        return
+                }
+
+                d.nextLine()
+                top.rows++
+                if !d.checkLength(ln.num, top.rows) {
+                        return
+                }
+                if ln.indent != top.indent+d.indent {
+                        d.diagnose(ln.num, 1, ReasonBadIndentation, "list item should be indented %d spaces, found %d", top.indent+d.indent, ln.indent)
+                }
+                d.listItem(ln)
+                return
+        }
+
+        if !ok || ln.indent < top.indent {
+                d.stack = d.stack[:len(d.stack)-1]
+                d.emit(objectEnd, nil)
+                return
+        }
+
+        d.nextLine()
+        if ln.indent > top.indent {
+                // Nothing opened a nested block here; read the line as a field of
+                // the current object
+                d.diagnose(ln.num, 1, ReasonBadIndentation, "unexpected indentation of %d spaces, expected %d", ln.indent, top.indent)
+        }
+        d.field(ln)
+}
+
+// row emits one row of a tabular array as an object keyed by the header's
+// field names, which are boxed once per table rather than once per row.
+func (d *decoder) row(ln line, fields []interface{}, delim byte) {
+        cells := splitDelimited(ln.text, delim)
+        if len(cells) != len(fields) {
+                d.diagnose(ln.num, ln.indent+1, ReasonRowWidth, "row has %d values but the header declares %d fields", len(cells), len(fields))
+        }
+
+        d.emit(objectStart, nil)
+        for i, field := range fields {
+                if i >= len(cells) {
+                        break
+                }
+                d.emit(keyEvent, field)
+                d.emit(valueEvent, d.scalar(ln, cells[i]))
+        }
+        d.emit(objectEnd, nil)
+}
+
+func (d *decoder) field(ln line) {
+        key, rest, ok := splitKey(ln.text)
+        if !ok {
+                // Lines without a key carry no data
+                d.diagnose(ln.num, ln.indent+1, ReasonSyntax, "expected a key followed by a colon")
+                return
+        }
+
+        if isArrayHeader(rest) {
+                d.emitKey(key, ln)
+                d.array(ln, rest)
+                return
+        }
+
+        value, ok := strings.CutPrefix(rest, ":")
+        if !ok {
+                // Not a well-formed field; keep everything before the first colon
+                // as the key, as older versions of the parser did
+                d.diagnose(ln.num, ln.indent+len(key)+1, ReasonSyntax, "malformed field %q", ln.text)
+                if key, value, ok = strings.Cut(ln.text, ":"); !ok {
+                        return
+                }
+                key = strings.TrimSpace(key)
+        }
+
+        d.emitKey(key, ln)
+
+        if value = strings.TrimSpace(value); value != "" {
+                d.emit(valueEvent, d.scalar(ln, value))
+                return
+        }
+
+        // An empty value opens a nested object whose fields are the following,
+        // more deeply indented lines
+        d.emit(objectStart, nil)
+        if child, ok := d.peekLine(); ok && child.indent > ln.indent {
+                if child.indent != ln.indent+d.indent {
+                        d.diagnose(child.num, 1, ReasonBadIndentation, "nested field should be indented %d spaces, found %d", ln.indent+d.indent, child.indent)
+                }
+                d.push(frame{kind: objectFrame, indent: child.indent, keys: make(map[string]bool)})
+                return
+        }
+        d.emit(objectEnd, nil)
+}
+
+// array emits the array whose header starts header, found on ln. Tabular
+// rows and list items follow on the lines indented deeper than ln.
+func (d *decoder) array(ln line, header string) {
+        // Handle tabular array syntax: [n]{field1,field2}: followed by n
+        // indented rows of values
+        h, _ := scanArrayHeader(header)
+        if !d.checkLength(ln.num, h.size) {
+                return
+        }
+
+        if h.table {
+                if !d.checkKeys(ln.num, len(h.fields)) {
+                        return
+                }
+                if h.rest != "" {
+                        d.diagnose(ln.num, ln.indent+1, ReasonSyntax, "unexpected values after tabular array header")
+                }
+
+                names := make([]interface{}, len(h.fields))
+                for i, field := range h.fields {
+                        names[i] = field
+                }
+
+                d.emit(tableStart, nil)
+                d.push(frame{
+                        kind:   tableFrame,
+                        indent: ln.indent,
+                        line:   ln.num,
+                        fields: names,
+                        delim:  h.delim,
+                        size:   h.size,
+                })
+                return
+        }
+
+        // Handle array syntax: [n]: value1,value2,value3
+        d.emit(arrayStart, nil)
+
+        if h.rest == "" && h.size > 0 {
+                // A header without values opens an expanded list of n "- " items
+                d.push(frame{
+                        kind:   listFrame,
+                        indent: ln.indent,
+                        line:   ln.num,
+                        size:   h.size,
+                })
+                return
+        }
+
+        if h.rest != "" {
+                cells := splitDelimited(h.rest, h.delim)
+                if len(cells) != h.size {
+                        d.diagnose(ln.num, ln.indent+1, ReasonLengthMismatch, "array declares %d values but has %d", h.size, len(cells))
+                }
+
+                for i, val := range cells {
                         // Ensure we don't exceed the specified size
-                        if len(objects) > size {
-                                objects = objects[:size]
+                        if i >= h.size {
+                                break
                         }
-                        
-                        data.Fields[key] = objects
-                        continue
+                        d.emit(valueEvent, d.scalar(ln, val))
+                }
+        }
+
+        d.emit(arrayEnd, nil)
+}
+
+// listItem emits one "- " item of an expanded list. An item is a primitive,
+// a nested array header, or an object whose first field shares the marker's
+// line and whose other fields line up with it. A bare "-" is an empty
+// object.
+func (d *decoder) listItem(ln line) {
+        text, ok := strings.CutPrefix(ln.text, "-")
+        if !ok || (text != "" && text[0] != ' ') {
+                d.diagnose(ln.num, ln.indent+1, ReasonSyntax, "expected a list item starting with \"- \"")
+                text = ln.text
+        }
+
+        text = strings.TrimSpace(text)
+        if text == "" {
+                d.emit(objectStart, nil)
+                d.emit(objectEnd, nil)
+                return
+        }
+
+        if strings.HasPrefix(text, "[") && isArrayHeader(text) {
+                d.array(line{num: ln.num, indent: ln.indent, text: text}, text)
+                return
+        }
+
+        if _, rest, ok := splitKey(text); ok && rest != "" {
+                d.emit(objectStart, nil)
+                d.push(frame{kind: objectFrame, indent: ln.indent + d.indent, keys: make(map[string]bool)})
+                if d.halted {
+                        return
+                }
+                d.field(line{num: ln.num, indent: ln.indent + d.indent, text: text})
+                return
+        }
+
+        d.emit(valueEvent, d.scalar(ln, text))
+}
+
+// finish consumes whatever is left of the document once its root value has
+// been built, so that anything after it is reported.
+func (d *decoder) finish() {
+        for {
+                if _, ok := d.next(); !ok {
+                        return
                 }
+        }
+}
 
-                // Handle nested objects (indented lines)
-                if strings.HasPrefix(line, "  ") && (inObject || inArray) {
-                        nestedLine := strings.TrimSpace(line)
-                        if strings.Contains(nestedLine, ":") {
-                                parts := strings.SplitN(nestedLine, ":", 2)
-                                if len(parts) == 2 {
-                                        nestedKey := strings.TrimSpace(parts[0])
-                                        nestedValue := strings.TrimSpace(parts[1])
-                                        
-                                        if inObject {
-                                                currentObject[nestedKey] = nestedValue
-                                        } else if inArray {
-                                                // For arrays, we'd need more complex handling
-                                                // For now, we'll treat it as a simple value
-                                                if currentArray != nil {
-                                                        currentArray = append(currentArray, nestedValue)
-                                                }
-                                        }
-                                }
+// value builds the Go value that starts with ev, consuming the events of any
+// nested objects and arrays.
+func (d *decoder) value(ev event) interface{} {
+        switch ev.kind {
+        case objectStart:
+                obj := make(map[string]interface{})
+                for {
+                        keyEv, ok := d.next()
+                        if !ok || keyEv.kind != keyEvent {
+                                return obj
                         }
-                        continue
+                        valEv, _ := d.next()
+                        if path, ok := keyEv.value.(pathKey); ok {
+                                d.expandPath(obj, path, d.value(valEv))
+                                continue
+                        }
+                        obj[keyEv.value.(string)] = d.value(valEv)
                 }
+        case arrayStart:
+                arr := make([]interface{}, 0)
+                for {
+                        itemEv, ok := d.next()
+                        if !ok || itemEv.kind == arrayEnd {
+                                return arr
+                        }
+                        arr = append(arr, d.value(itemEv))
+                }
+        case tableStart:
+                rows := make([]map[string]interface{}, 0)
+                for {
+                        rowEv, ok := d.next()
+                        if !ok || rowEv.kind == arrayEnd {
+                                return rows
+                        }
+                        row, _ := d.value(rowEv).(map[string]interface{})
+                        rows = append(rows, row)
+                }
+        default:
+                return ev.value
+        }
+}
 
-                // Reset nested context
-                inObject = false
-                inArray = false
-                currentObject = nil
-                currentArray = nil
-
-                // Handle simple key-value pairs
-                if strings.Contains(line, ":") {
-                        parts := strings.SplitN(line, ":", 2)
-                        if len(parts) == 2 {
-                                key := strings.TrimSpace(parts[0])
-                                value := strings.TrimSpace(parts[1])
-                                
-                                // Check if the value indicates a nested object
-                                if value == "" {
-                                        currentObject = make(map[string]interface{})
-                                        data.Fields[key] = currentObject
-                                        inObject = true
-                                } else {
-                                        data.Fields[key] = value
-                                }
+// orderedValue is like value, but builds objects that keep the order of
+// their keys, so the document can be written back as it was read.
+func (d *decoder) orderedValue(ev event) interface{} {
+        switch ev.kind {
+        case objectStart:
+                obj := newOrderedMap()
+                for {
+                        keyEv, ok := d.next()
+                        if !ok || keyEv.kind != keyEvent {
+                                return obj
                         }
+                        valEv, _ := d.next()
+                        obj.set(keyEv.value.(string), d.orderedValue(valEv))
+                }
+        case arrayStart, tableStart:
+                arr := make([]interface{}, 0)
+                for {
+                        itemEv, ok := d.next()
+                        if !ok || itemEv.kind == arrayEnd {
+                                return arr
+                        }
+                        arr = append(arr, d.orderedValue(itemEv))
+                }
+        default:
+                return ev.value
+        }
+}
+
+// parsePrimitive infers the type of a scalar token: quoted strings are always
+// strings, while true, false, null and numeric literals decode to bool, nil,
+// int64 or float64. Anything else is an unquoted string.
+func parsePrimitive(token string) interface{} {
+        if strings.HasPrefix(token, `"`) {
+                if s, ok := unquote(token); ok {
+                        return s
+                }
+                return token
+        }
+
+        switch token {
+        case "true":
+                return true
+        case "false":
+                return false
+        case "null":
+                return nil
+        }
+
+        if isNumber(token) {
+                i, err := strconv.ParseInt(token, 10, 64)
+                if err == nil {
+                        return i
+                }
+                // Integers too large for an int64, such as those of a uint64, are
+                // kept exactly
+                if errors.Is(err, strconv.ErrRange) {
+                        return json.Number(token)
+                }
+                if f, err := strconv.ParseFloat(token, 64); err == nil {
+                        return f
+                }
+        }
+
+        return token
+}
+
+// splitKey separates a field line into its key and the remainder, which
+// starts at the array header or the colon. Keys may be double-quoted, in
+// which case they can contain any character.
+func splitKey(text string) (key, rest string, ok bool) {
+        if strings.HasPrefix(text, `"`) {
+                end := closingQuote(text)
+                if end < 0 {
+                        return "", "", false
+                }
+                if key, ok = unquote(text[:end+1]); !ok {
+                        return "", "", false
+                }
+                return key, text[end+1:], true
+        }
+
+        i := strings.IndexAny(text, ":[")
+        if i < 0 {
+                return "", "", false
+        }
+        return strings.TrimSpace(text[:i]), text[i:], true
+}
+
+// closingQuote returns the index of the quote that closes the quoted string
+// at the start of s, or -1 if it is unterminated.
+func closingQuote(s string) int {
+        for i := 1; i < len(s); i++ {
+                switch s[i] {
+                case '\\':
+                        i++
+                case '"':
+                        return i
                 }
         }
+        return -1
+}
+
+// unquote decodes a double-quoted string, resolving the \\, \", \n, \r and
+// \t escapes. ok is false if s is not a single well-formed quoted string.
+func unquote(s string) (string, bool) {
+        if len(s) < 2 || s[0] != '"' || closingQuote(s) != len(s)-1 {
+                return "", false
+        }
+
+        var b strings.Builder
+        for i := 1; i < len(s)-1; i++ {
+                c := s[i]
+                if c != '\\' {
+                        b.WriteByte(c)
+                        continue
+                }
+
+                i++
+                switch s[i] {
+                case '\\', '"':
+                        b.WriteByte(s[i])
+                case 'n':
+                        b.WriteByte('\n')
+                case 'r':
+                        b.WriteByte('\r')
+                case 't':
+                        b.WriteByte('\t')
+                default:
+                        return "", false
+                }
+        }
+
+        return b.String(), true
+}
+
+// splitDelimited splits an array row on delim, ignoring delimiters inside
+// quoted strings. Cells are trimmed but otherwise left undecoded.
+func splitDelimited(s string, delim byte) []string {
+        cells := make([]string, 0, strings.Count(s, string(delim))+1)
+        start := 0
+        inQuotes := false
 
+        for i := 0; i < len(s); i++ {
+                switch c := s[i]; {
+                case c == '\\' && inQuotes:
+                        i++
+                case c == '"':
+                        inQuotes = !inQuotes
+                case c == delim && !inQuotes:
+                        cells = append(cells, strings.TrimSpace(s[start:i]))
+                        start = i + 1
+                }
+        }
+
+        return append(cells, strings.TrimSpace(s[start:]))
+}
+
+// ParseToon reads a document leniently; see DecodeOptions.
+func (p *Parser) ParseToon(toon string) (*ToonData, error) {
+        return p.ParseToonWithOptions(toon, DecodeOptions{})
+}
+
+func (p *Parser) ParseToonWithOptions(toon string, opts DecodeOptions) (*ToonData, error) {
+        d := newDecoder(strings.NewReader(toon), p.limits)
+        d.expand = opts.ExpandPaths
+        if opts.Indent > 0 {
+                d.indent = opts.Indent
+        }
+
+        rootEv, _ := d.next()
+        value := d.value(rootEv)
+        d.finish()
+        if (opts.Strict || d.halted) && len(d.diags) > 0 {
+                return nil, &ParseError{Diagnostics: d.diagnostics()}
+        }
+
+        fields, _ := value.(map[string]interface{})
+        return &ToonData{Fields: fields, Value: value}, nil
+}
+
+// ParseOrdered reads a document leniently, as ParseToon does, into values
+// whose objects keep the order of their keys. The objects are opaque, but
+// Path.Eval selects from them, and Marshal and encoding/json write them
+// with their keys in that order.
+func (p *Parser) ParseOrdered(toon string) (interface{}, error) {
+        d := newDecoder(strings.NewReader(toon), p.limits)
+        rootEv, _ := d.next()
+        data := d.orderedValue(rootEv)
+        d.finish()
+        if d.halted {
+                return nil, &ParseError{Diagnostics: d.diagnostics()}
+        }
         return data, nil
 }
 
+// ToonToJSON converts a document, read leniently as by ParseToon, to
+// indented JSON. Keys are written in the order they were read, so the
+// columns of a table keep the order of its header.
 func (p *Parser) ToonToJSON(toon string) (string, error) {
-        data, err := p.ParseToon(toon)
+        data, err := p.ParseOrdered(toon)
         if err != nil {
                 return "", err
         }
 
-        jsonData, err := json.MarshalIndent(data.Fields, "", "  ")
+        jsonData, err := json.MarshalIndent(data, "", "  ")
         if err != nil {
                 return "", err
         }
@@ -154,110 +988,416 @@ func (p *Parser) ToonToJSON(toon string) (string, error) {
         return string(jsonData), nil
 }
 
-func (p *Parser) JSONToTOON(jsonStr string) (string, error) {
-        var data map[string]interface{}
-        err := json.Unmarshal([]byte(jsonStr), &data)
+// ToonToJSONStrict converts a document to indented JSON as ToonToJSON
+// does, but reads it strictly, so a malformed one is reported as a
+// *ParseError rather than partly lost.
+func (p *Parser) ToonToJSONStrict(toon string) (string, error) {
+        data, err := p.decodeOrdered(toon)
+        if err != nil {
+                return "", err
+        }
+
+        jsonData, err := json.MarshalIndent(data, "", "  ")
         if err != nil {
                 return "", err
         }
 
-        return p.mapToTOON(data, 0), nil
+        return string(jsonData), nil
 }
 
-func (p *Parser) mapToTOON(data interface{}, indent int) string {
+// Reformat rewrites a TOON document with opts, keeping the order of its
+// keys unless opts.SortKeys is set. The document is read strictly, so a
+// malformed one is reported as a *ParseError rather than partly lost.
+func (p *Parser) Reformat(toon string, opts EncodeOptions) (string, error) {
+        if err := opts.validate(); err != nil {
+                return "", err
+        }
+
+        data, err := p.decodeOrdered(toon)
+        if err != nil {
+                return "", err
+        }
+
         var result strings.Builder
-        indentStr := strings.Repeat("  ", indent)
-
-        switch v := data.(type) {
-        case map[string]interface{}:
-                for key, value := range v {
-                        result.WriteString(indentStr)
-                        result.WriteString(key)
-                        result.WriteString(": ")
-                        
-                        switch val := value.(type) {
-                        case string:
-                                result.WriteString(val)
-                        case map[string]interface{}:
-                                result.WriteString("\n")
-                                result.WriteString(p.mapToTOON(val, indent+1))
-                                continue
-                        case []interface{}:
-                                result.WriteString(p.arrayToTOON(val, key, indent))
-                                continue
-                        default:
-                                result.WriteString(fmt.Sprintf("%v", val))
-                        }
-                        
-                        result.WriteString("\n")
-                }
-        case []interface{}:
-                result.WriteString(p.arrayToTOON(v, "", indent))
+        p.documentToTOON(&result, data, opts)
+        return result.String(), nil
+}
+
+// decodeOrdered reads a document strictly into values whose objects keep
+// the order of their keys, for converting it to other formats.
+func (p *Parser) decodeOrdered(toon string) (interface{}, error) {
+        d := newDecoder(strings.NewReader(toon), p.limits)
+        rootEv, _ := d.next()
+        data := d.orderedValue(rootEv)
+        d.finish()
+        if len(d.diags) > 0 {
+                return nil, &ParseError{Diagnostics: d.diagnostics()}
+        }
+        return data, nil
+}
+
+func (p *Parser) JSONToTOON(jsonStr string) (string, error) {
+        return p.JSONToTOONWithOptions(jsonStr, EncodeOptions{})
+}
+
+func (p *Parser) JSONToTOONWithOptions(jsonStr string, opts EncodeOptions) (string, error) {
+        data, err := decodeOrderedJSON([]byte(jsonStr))
+        if err != nil {
+                return "", err
         }
 
-        return result.String()
+        if err := opts.validate(); err != nil {
+                return "", err
+        }
+
+        var result strings.Builder
+        p.documentToTOON(&result, data, opts)
+        return result.String(), nil
 }
 
-func (p *Parser) arrayToTOON(array []interface{}, key string, indent int) string {
+// documentToTOON writes a whole document: the fields of an object, or else
+// a root array or a single primitive.
+func (p *Parser) documentToTOON(out io.StringWriter, data interface{}, opts EncodeOptions) {
+        if array, ok := arrayItems(data); ok {
+                p.arrayToTOON(out, array, "", 0, opts)
+                return
+        }
+        if !isObject(data) {
+                out.WriteString(formatPrimitive(data, 0))
+                out.WriteString("\n")
+                return
+        }
+        p.mapToTOON(out, data, 0, opts)
+}
+
+func (p *Parser) mapToTOON(out io.StringWriter, data interface{}, indent int, opts EncodeOptions) {
+        indentStr := opts.pad(indent)
+
+        keys, values, _ := objectFields(data, opts.SortKeys)
+        for _, key := range keys {
+                p.fieldToTOON(out, indentStr, key, values[key], indent, opts)
+        }
+}
+
+// fieldToTOON writes one field of an object whose fields sit at indent.
+// prefix is written before the key on the first line; it is normally the
+// indentation, or the list marker for the first field of a list item.
+func (p *Parser) fieldToTOON(out io.StringWriter, prefix, key string, value interface{}, indent int, opts EncodeOptions) {
+        out.WriteString(prefix)
+
+        name := formatKey(key)
+        if opts.FoldKeys {
+                name, value = foldKey(key, value)
+        }
+
+        if array, ok := arrayItems(value); ok {
+                p.arrayToTOON(out, array, name, indent, opts)
+                return
+        }
+
+        if isObject(value) {
+                // Nested objects open a new indentation level
+                out.WriteString(name)
+                out.WriteString(":\n")
+                p.mapToTOON(out, value, indent+1, opts)
+                return
+        }
+
+        out.WriteString(name)
+        out.WriteString(": ")
+        out.WriteString(formatPrimitive(value, 0))
+        out.WriteString("\n")
+}
+
+// arrayToTOON writes an array starting with its header. Arrays of primitives
+// are written inline, arrays of objects that share the same primitive fields
+// as a table, and anything else as an expanded list with one "- " item per
+// line. name is the key as written, and may be empty to write the header
+// alone, as for nested arrays.
+func (p *Parser) arrayToTOON(out io.StringWriter, array []interface{}, name string, indent int, opts EncodeOptions) {
         if len(array) == 0 {
-                return ""
+                out.WriteString(fmt.Sprintf("%s[%s]:\n", name, opts.length(0)))
+                return
+        }
+
+        delim := opts.delimiter()
+
+        // Simple array format
+        if isPrimitiveArray(array) {
+                line := fmt.Sprintf("%s[%s%s]: %s", name, opts.length(len(array)), delimiterMarker(delim), p.interfaceArrayToString(array, delim))
+                if opts.fits(indent, line) {
+                        out.WriteString(line)
+                        out.WriteString("\n")
+                        return
+                }
         }
 
-        // Check if it's an array of objects (table format)
-        if _, ok := array[0].(map[string]interface{}); ok && key != "" {
-                var result strings.Builder
-                result.WriteString(fmt.Sprintf("%s[%d]{", key, len(array)))
-                
-                // Get all unique field names from all objects
-                fieldSet := make(map[string]bool)
-                for _, item := range array {
-                        if obj, ok := item.(map[string]interface{}); ok {
-                                for k := range obj {
-                                        fieldSet[k] = true
-                                }
+        // Table format, when every object has the same primitive fields
+        if fields, ok := tabularFields(array, opts); ok {
+                rows := make([]string, len(array))
+                for i, item := range array {
+                        _, obj, _ := objectFields(item, false)
+                        values := make([]string, len(fields))
+                        for j, field := range fields {
+                                values[j] = formatPrimitive(obj[field], delim)
+                        }
+                        rows[i] = strings.Join(values, string(delim))
+                        if !opts.fits(indent+1, rows[i]) {
+                                rows = nil
+                                break
                         }
                 }
-                
-                // Convert field set to sorted slice
-                fields := make([]string, 0, len(fieldSet))
-                for field := range fieldSet {
-                        fields = append(fields, field)
-                }
-                
-                result.WriteString(strings.Join(fields, ","))
-                result.WriteString("}:\n")
-                
-                // Write each object as a comma-separated line
-                for _, item := range array {
-                        if obj, ok := item.(map[string]interface{}); ok {
-                                var values []string
-                                for _, field := range fields {
-                                        if val, exists := obj[field]; exists {
-                                                values = append(values, fmt.Sprintf("%v", val))
-                                        } else {
-                                                values = append(values, "")
-                                        }
-                                }
-                                result.WriteString(strings.Repeat("  ", indent+1))
-                                result.WriteString(strings.Join(values, ","))
-                                result.WriteString("\n")
+
+                if rows != nil {
+                        out.WriteString(tableHeader(name, len(array), fields, opts))
+
+                        // Write each object as a delimited line
+                        for _, row := range rows {
+                                out.WriteString(opts.pad(indent + 1))
+                                out.WriteString(row)
+                                out.WriteString("\n")
                         }
+                        return
                 }
-                
-                return result.String()
         }
-        
-        // Simple array format
-        if key != "" {
-                return fmt.Sprintf("%s[%d]: %s", key, len(array), p.interfaceArrayToString(array))
+
+        // Expanded list format
+        out.WriteString(fmt.Sprintf("%s[%s]:\n", name, opts.length(len(array))))
+        for _, item := range array {
+                p.listItemToTOON(out, item, indent+1, opts)
+        }
+}
+
+// listItemToTOON writes one item of an expanded list whose "- " markers sit
+// at indent. The fields of an object item line up with its first field,
+// which shares the marker's line.
+func (p *Parser) listItemToTOON(out io.StringWriter, item interface{}, indent int, opts EncodeOptions) {
+        marker := opts.pad(indent) + "- "
+
+        if keys, values, ok := objectFields(item, opts.SortKeys); ok {
+                if len(keys) == 0 {
+                        out.WriteString(strings.TrimRight(marker, " ") + "\n")
+                        return
+                }
+
+                fieldIndent := opts.pad(indent + 1)
+                for i, key := range keys {
+                        prefix := fieldIndent
+                        if i == 0 {
+                                prefix = marker
+                        }
+                        p.fieldToTOON(out, prefix, key, values[key], indent+1, opts)
+                }
+                return
+        }
+
+        out.WriteString(marker)
+        if array, ok := arrayItems(item); ok {
+                p.arrayToTOON(out, array, "", indent, opts)
+                return
+        }
+        out.WriteString(formatPrimitive(item, 0))
+        out.WriteString("\n")
+}
+
+// isPrimitiveArray reports whether no element of array is an object or an
+// array.
+func isPrimitiveArray(array []interface{}) bool {
+        for _, item := range array {
+                if _, ok := arrayItems(item); ok || isObject(item) {
+                        return false
+                }
+        }
+        return true
+}
+
+// tabularFields returns the header of array written as a table. ok is false
+// unless every element is an object with the same set of fields, all of them
+// primitive, and there are at least opts.TabularThreshold of them.
+func tabularFields(array []interface{}, opts EncodeOptions) (fields []string, ok bool) {
+        if len(array) < opts.TabularThreshold {
+                return nil, false
+        }
+
+        for i, item := range array {
+                keys, values, isObj := objectFields(item, opts.SortKeys)
+                if !isObj || len(keys) == 0 {
+                        return nil, false
+                }
+
+                if i == 0 {
+                        fields = keys
+                } else if len(keys) != len(fields) {
+                        return nil, false
+                }
+
+                for _, field := range fields {
+                        value, exists := values[field]
+                        if !exists {
+                                return nil, false
+                        }
+                        if _, isArray := arrayItems(value); isArray || isObject(value) {
+                                return nil, false
+                        }
+                }
+        }
+        return fields, true
+}
+
+// tableHeader writes the header line of a tabular array: name[n]{fields}:,
+// where name is the key as written.
+func tableHeader(name string, n int, fields []string, opts EncodeOptions) string {
+        delim := opts.delimiter()
+        header := make([]string, len(fields))
+        for i, field := range fields {
+                header[i] = formatKey(field)
+        }
+
+        return fmt.Sprintf("%s[%s%s]{%s}:\n", name, opts.length(n), delimiterMarker(delim), strings.Join(header, string(delim)))
+}
+
+// delimiterMarker returns what an array header carries after its length to
+// declare delim. Commas are the default and need no marker.
+func delimiterMarker(delim byte) string {
+        if delim == ',' {
+                return ""
         }
-        return p.interfaceArrayToString(array)
+        return string(delim)
 }
 
-func (p *Parser) interfaceArrayToString(array []interface{}) string {
+func (p *Parser) interfaceArrayToString(array []interface{}, delim byte) string {
         var values []string
         for _, item := range array {
-                values = append(values, fmt.Sprintf("%v", item))
+                values = append(values, formatPrimitive(item, delim))
         }
-        return strings.Join(values, ",")
-}
\ No newline at end of file
+        return strings.Join(values, string(delim))
+}
+
+// formatPrimitive writes a scalar so that parsePrimitive reads back the same
+// value and type. delim is the delimiter of the enclosing array row, or 0
+// outside of arrays.
+func formatPrimitive(value interface{}, delim byte) string {
+        switch v := value.(type) {
+        case nil:
+                return "null"
+        case string:
+                return formatString(v, delim)
+        case bool:
+                return strconv.FormatBool(v)
+        case int:
+                return strconv.Itoa(v)
+        case int64:
+                return strconv.FormatInt(v, 10)
+        case uint64:
+                return strconv.FormatUint(v, 10)
+        case float32:
+                return formatFloat(float64(v))
+        case float64:
+                return formatFloat(v)
+        case json.Number:
+                return formatNumber(v)
+        default:
+                return fmt.Sprintf("%v", v)
+        }
+}
+
+// formatFloat writes numbers in plain decimal form without exponents.
+// Non-finite values have no TOON representation and become null.
+func formatFloat(f float64) string {
+        if math.IsNaN(f) || math.IsInf(f, 0) {
+                return "null"
+        }
+        if f == 0 {
+                // Normalizes negative zero
+                return "0"
+        }
+        return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// formatNumber writes a number read from JSON or YAML in the same canonical
+// form as formatFloat, keeping integers exact. JSON numbers too large for a
+// float64 are refused when read, but YAML integers are not, and those become
+// null like the infinities of YAML.
+func formatNumber(n json.Number) string {
+        if i, err := n.Int64(); err == nil {
+                return strconv.FormatInt(i, 10)
+        }
+        f, err := strconv.ParseFloat(n.String(), 64)
+        if err != nil && !errors.Is(err, strconv.ErrRange) {
+                return n.String()
+        }
+        return formatFloat(f)
+}
+
+// formatString writes s bare when that is unambiguous and quotes it
+// otherwise.
+func formatString(s string, delim byte) string {
+        if needsQuotes(s, delim) {
+                return quote(s)
+        }
+        return s
+}
+
+// needsQuotes reports whether s must be quoted to read back as the same
+// string: when it is empty or padded, looks like another type, contains
+// structural characters or the active delimiter, or starts like a comment or
+// list item.
+func needsQuotes(s string, delim byte) bool {
+        if s == "" || s != strings.TrimSpace(s) {
+                return true
+        }
+
+        switch s {
+        case "true", "false", "null":
+                return true
+        }
+
+        if isNumericLike(s) {
+                return true
+        }
+
+        if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "#") {
+                return true
+        }
+
+        if strings.ContainsAny(s, ":\"\\[]{}\n\r\t") {
+                return true
+        }
+
+        return delim != 0 && strings.IndexByte(s, delim) >= 0
+}
+
+// formatKey quotes keys that are not plain identifiers.
+func formatKey(key string) string {
+        if isBareKey(key) {
+                return key
+        }
+        return quote(key)
+}
+
+// quote wraps s in double quotes, escaping backslashes, quotes and line
+// breaks.
+func quote(s string) string {
+        var b strings.Builder
+        b.Grow(len(s) + 2)
+        b.WriteByte('"')
+
+        for i := 0; i < len(s); i++ {
+                switch c := s[i]; c {
+                case '\\', '"':
+                        b.WriteByte('\\')
+                        b.WriteByte(c)
+                case '\n':
+                        b.WriteString(`\n`)
+                case '\r':
+                        b.WriteString(`\r`)
+                case '\t':
+                        b.WriteString(`\t`)
+                default:
+                        b.WriteByte(c)
+                }
+        }
+
+        b.WriteByte('"')
+        return b.String()
+}
@@ -0,0 +1,1174 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// The YAML reader below handles the subset of YAML that configuration files
+// use: block mappings and sequences, plain, quoted and block scalars,
+// comments, and flow collections such as [a, b] and {a: 1}, which may span
+// lines. Plain scalars are typed by the YAML 1.2 core schema, so yes and no
+// are strings. Anchors, aliases, tags, complex keys and streams of several
+// documents are not supported and are reported as errors.
+
+// yamlMaxDepth bounds the nesting of flow collections, as encoding/json
+// bounds that of JSON.
+const yamlMaxDepth = 10000
+
+// YAMLToTOON converts a YAML document to TOON. Mappings become objects,
+// keeping the order of their keys, and sequences become arrays, which are
+// written as tables when their items are mappings of the same primitive
+// fields.
+func (p *Parser) YAMLToTOON(yamlStr string) (string, error) {
+	return p.YAMLToTOONWithOptions(yamlStr, EncodeOptions{})
+}
+
+func (p *Parser) YAMLToTOONWithOptions(yamlStr string, opts EncodeOptions) (string, error) {
+	data, err := decodeYAML(yamlStr)
+	if err != nil {
+		return "", err
+	}
+
+	if err := opts.validate(); err != nil {
+		return "", err
+	}
+
+	var result strings.Builder
+	p.documentToTOON(&result, data, opts)
+	return result.String(), nil
+}
+
+// ToonToYAML converts a TOON document, read strictly, to YAML in block
+// style, keeping the order of keys. Strings of several lines are written as
+// literal block scalars.
+func (p *Parser) ToonToYAML(toon string) (string, error) {
+	data, err := p.decodeOrdered(toon)
+	if err != nil {
+		return "", err
+	}
+
+	var result strings.Builder
+	writeYAML(&result, data, 0)
+	return result.String(), nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	// text is the line after its indentation, and raw the whole line.
+	text string
+	raw  string
+}
+
+// content reports whether the line holds more than whitespace and a
+// comment.
+func (ln yamlLine) content() bool {
+	text := strings.TrimLeft(ln.text, " \t")
+	return text != "" && text[0] != '#'
+}
+
+type yamlReader struct {
+	lines []yamlLine
+	pos   int
+	// unterminated is the number of the last line if no line break ends
+	// it, which matters to a block scalar that ends there.
+	unterminated int
+}
+
+func yamlErrorf(num int, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", num, fmt.Sprintf(format, args...))
+}
+
+// decodeYAML reads a YAML document into the same values as
+// decodeOrderedJSON: mappings become *orderedMap and sequences
+// []interface{}.
+func decodeYAML(src string) (interface{}, error) {
+	y, err := newYAMLReader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := y.block(-1)
+	if err != nil {
+		return nil, err
+	}
+	if ln, ok, err := y.next(); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, yamlErrorf(ln.num, "unexpected indentation")
+	}
+	return value, nil
+}
+
+// newYAMLReader splits src into lines, dropping the directives and document
+// markers around a single document.
+func newYAMLReader(src string) (*yamlReader, error) {
+	src = strings.TrimPrefix(src, "\ufeff")
+	y := &yamlReader{}
+	started, ended := false, false
+
+	// The newline at the end of the last line does not start another
+	raws := strings.Split(strings.TrimSuffix(src, "\n"), "\n")
+	if !strings.HasSuffix(src, "\n") {
+		y.unterminated = len(raws)
+	}
+	for i, raw := range raws {
+		raw = strings.TrimSuffix(raw, "\r")
+		if !utf8.ValidString(raw) {
+			return nil, yamlErrorf(i+1, "invalid UTF-8")
+		}
+		ln := yamlLine{num: i + 1, raw: raw}
+		ln.indent = len(raw) - len(strings.TrimLeft(raw, " "))
+		ln.text = raw[ln.indent:]
+
+		switch {
+		case ended:
+			if ln.content() {
+				return nil, yamlErrorf(ln.num, "documents after the first are not supported")
+			}
+			continue
+		case raw == "..." || strings.HasPrefix(raw, "... "):
+			ended = true
+			continue
+		case raw == "---" || strings.HasPrefix(raw, "--- ") || strings.HasPrefix(raw, "---\t"):
+			if started {
+				return nil, yamlErrorf(ln.num, "documents after the first are not supported")
+			}
+			started = true
+			// The document may start on the line of its marker
+			ln.text = strings.TrimLeft(raw[3:], " \t")
+			ln.indent = len(raw) - len(ln.text)
+		case strings.HasPrefix(raw, "%") && !started:
+			// Directives, such as %YAML 1.2, change nothing here
+			continue
+		}
+
+		if ln.content() {
+			started = true
+		}
+		y.lines = append(y.lines, ln)
+	}
+
+	return y, nil
+}
+
+// next returns the next line with content, skipping blank lines and
+// comments.
+func (y *yamlReader) next() (yamlLine, bool, error) {
+	for ; y.pos < len(y.lines); y.pos++ {
+		ln := y.lines[y.pos]
+		if !ln.content() {
+			continue
+		}
+		if ln.text[0] == '\t' {
+			return ln, false, yamlErrorf(ln.num, "tabs are not allowed in indentation")
+		}
+		return ln, true, nil
+	}
+	return yamlLine{}, false, nil
+}
+
+// block reads the node on the lines that follow, which must be indented
+// more than parent, or returns nil if there is none.
+func (y *yamlReader) block(parent int) (interface{}, error) {
+	ln, ok, err := y.next()
+	if err != nil || !ok || ln.indent <= parent {
+		return nil, err
+	}
+	return y.node(ln, parent)
+}
+
+// node reads the node that starts at ln, the next line, inside a node
+// indented at parent.
+func (y *yamlReader) node(ln yamlLine, parent int) (interface{}, error) {
+	if isYAMLItem(ln.text) {
+		return y.sequence(ln.indent)
+	}
+	if _, _, ok, err := splitYAMLKey(ln.num, ln.text); err != nil {
+		return nil, err
+	} else if ok {
+		return y.mapping(ln.indent)
+	}
+
+	y.pos++
+	return y.inline(ln, ln.text, parent)
+}
+
+// mapping reads the entries of a block mapping indented at indent.
+func (y *yamlReader) mapping(indent int) (interface{}, error) {
+	obj := newOrderedMap()
+	for {
+		ln, ok, err := y.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok || ln.indent < indent {
+			return obj, nil
+		}
+		if ln.indent > indent {
+			return nil, yamlErrorf(ln.num, "unexpected indentation")
+		}
+		if isYAMLItem(ln.text) {
+			return nil, yamlErrorf(ln.num, "expected a mapping key, found a sequence item")
+		}
+
+		key, rest, ok, err := splitYAMLKey(ln.num, ln.text)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, yamlErrorf(ln.num, "expected a mapping key")
+		}
+		if _, dup := obj.values[key]; dup {
+			return nil, yamlErrorf(ln.num, "duplicate key %q", key)
+		}
+		y.pos++
+
+		var value interface{}
+		if rest == "" || rest[0] == '#' {
+			// The value is on the lines below. A sequence may be indented
+			// as far as its key
+			next, ok, _ := y.next()
+			if ok && next.indent == indent && isYAMLItem(next.text) {
+				value, err = y.sequence(indent)
+			} else {
+				value, err = y.block(indent)
+			}
+		} else {
+			value, err = y.inline(ln, rest, indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		obj.set(key, value)
+	}
+}
+
+// sequence reads the items of a block sequence whose dashes are at indent.
+func (y *yamlReader) sequence(indent int) (interface{}, error) {
+	items := make([]interface{}, 0)
+	for {
+		ln, ok, err := y.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok || ln.indent < indent || (ln.indent == indent && !isYAMLItem(ln.text)) {
+			return items, nil
+		}
+		if ln.indent > indent {
+			return nil, yamlErrorf(ln.num, "unexpected indentation")
+		}
+
+		rest := strings.TrimLeft(ln.text[1:], " \t")
+		if rest == "" || rest[0] == '#' {
+			y.pos++
+			item, err := y.block(indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+
+		_, _, entry, err := splitYAMLKey(ln.num, rest)
+		if err != nil {
+			return nil, err
+		}
+		var item interface{}
+		if entry || isYAMLItem(rest) {
+			// A mapping or sequence may start on the line of the dash,
+			// at the column of its first key or item
+			y.lines[y.pos] = yamlLine{num: ln.num, indent: ln.indent + len(ln.text) - len(rest), text: rest, raw: ln.raw}
+			item, err = y.node(y.lines[y.pos], indent)
+		} else {
+			y.pos++
+			item, err = y.inline(ln, rest, indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ") || strings.HasPrefix(text, "-\t")
+}
+
+func isYAMLEntry(num int, text string) bool {
+	_, _, ok, _ := splitYAMLKey(num, text)
+	return ok
+}
+
+// splitYAMLKey splits a mapping entry into its key and the text after the
+// colon. ok is false if text is not a mapping entry.
+func splitYAMLKey(num int, text string) (key, rest string, ok bool, err error) {
+	switch text[0] {
+	case '"', '\'':
+		end := yamlQuoteEnd(text)
+		if end < 0 {
+			return "", "", false, nil
+		}
+		after := strings.TrimLeft(text[end+1:], " \t")
+		if !strings.HasPrefix(after, ":") || (len(after) > 1 && after[1] != ' ' && after[1] != '\t') {
+			return "", "", false, nil
+		}
+		key, err := yamlQuoted(num, text[:end+1])
+		return key, strings.TrimSpace(after[1:]), err == nil, err
+	case '[', '{':
+		return "", "", false, nil
+	case '?':
+		if len(text) == 1 || text[1] == ' ' || text[1] == '\t' {
+			return "", "", false, yamlErrorf(num, "complex keys are not supported")
+		}
+	case '&', '*', '!':
+		return "", "", false, yamlErrorf(num, "anchors, aliases and tags are not supported")
+	}
+
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '#' && i > 0 && (text[i-1] == ' ' || text[i-1] == '\t'):
+			return "", "", false, nil
+		case text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ' || text[i+1] == '\t'):
+			key = strings.TrimRight(text[:i], " \t")
+			if key == "<<" {
+				return "", "", false, yamlErrorf(num, "merge keys are not supported")
+			}
+			return key, strings.TrimSpace(text[i+1:]), true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// inline reads the value written on line ln after a key or dash, which is
+// text, inside a node indented at parent. Block scalars, flow collections
+// and plain scalars may continue on the lines below.
+func (y *yamlReader) inline(ln yamlLine, text string, parent int) (interface{}, error) {
+	switch text[0] {
+	case '|', '>':
+		return y.blockScalar(ln, text, parent)
+	case '[', '{':
+		return y.flow(ln, text)
+	case '"', '\'':
+		text, err := y.continueQuoted(ln, text)
+		if err != nil {
+			return nil, err
+		}
+		end := yamlQuoteEnd(text)
+		if rest := strings.TrimSpace(text[end+1:]); rest != "" && rest[0] != '#' {
+			return nil, yamlErrorf(ln.num, "unexpected %q after quoted string", rest)
+		}
+		return yamlQuoted(ln.num, text[:end+1])
+	case '&', '*', '!':
+		return nil, yamlErrorf(ln.num, "anchors, aliases and tags are not supported")
+	case '@', '`':
+		return nil, yamlErrorf(ln.num, "plain scalars cannot start with %q", text[0])
+	}
+
+	s, commented := stripYAMLComment(text)
+	if commented {
+		return yamlPlain(s), nil
+	}
+
+	// A plain scalar continues on more indented lines, which are folded
+	// into it: a line break becomes a space, and each blank line a newline
+	var b strings.Builder
+	b.WriteString(s)
+	blanks := 0
+	for i := y.pos; i < len(y.lines); i++ {
+		next := y.lines[i]
+		if strings.TrimSpace(next.text) == "" {
+			blanks++
+			continue
+		}
+		if next.indent <= parent || !next.content() {
+			break
+		}
+		if isYAMLEntry(next.num, next.text) {
+			return nil, yamlErrorf(next.num, "unexpected indentation")
+		}
+
+		if blanks > 0 {
+			b.WriteString(strings.Repeat("\n", blanks))
+		} else {
+			b.WriteByte(' ')
+		}
+		part, commented := stripYAMLComment(strings.TrimLeft(next.text, " \t"))
+		b.WriteString(part)
+		blanks = 0
+		y.pos = i + 1
+		if commented {
+			break
+		}
+	}
+	return yamlPlain(b.String()), nil
+}
+
+// continueQuoted returns the quoted string that starts with text on line ln,
+// reading the lines below until it is closed.
+func (y *yamlReader) continueQuoted(ln yamlLine, text string) (string, error) {
+	blanks := 0
+	for yamlQuoteEnd(text) < 0 {
+		if y.pos >= len(y.lines) {
+			return "", yamlErrorf(ln.num, "unterminated quoted string")
+		}
+		next := strings.Trim(y.lines[y.pos].raw, " \t")
+		y.pos++
+		if next == "" {
+			blanks++
+			continue
+		}
+		text = foldQuoted(text, text[0] == '"', next, blanks)
+		blanks = 0
+	}
+	return text, nil
+}
+
+// foldQuoted continues a quoted string left open at the end of text with
+// the next line, after a number of blank lines. The line break is folded as
+// in a plain scalar, except that a break escaped with a backslash in a
+// double-quoted string is removed.
+func foldQuoted(text string, double bool, next string, blanks int) string {
+	trimmed := strings.TrimRight(text, " \t")
+	escaped := len(trimmed) - len(strings.TrimRight(trimmed, `\`))
+	switch {
+	case double && escaped%2 == 1:
+		return trimmed[:len(trimmed)-1] + strings.Repeat("\n", blanks) + next
+	case blanks > 0:
+		return trimmed + strings.Repeat("\n", blanks) + next
+	}
+	return trimmed + " " + next
+}
+
+// stripYAMLComment removes the comment and surrounding whitespace from the
+// text of a plain scalar, and reports whether there was a comment.
+func stripYAMLComment(text string) (string, bool) {
+	for i := 1; i < len(text); i++ {
+		if text[i] == '#' && (text[i-1] == ' ' || text[i-1] == '\t') {
+			return strings.TrimSpace(text[:i]), true
+		}
+	}
+	return strings.TrimSpace(text), false
+}
+
+// blockScalar reads a literal (|) or folded (>) block scalar whose header,
+// with its optional chomping and indentation indicators, ends line ln.
+func (y *yamlReader) blockScalar(ln yamlLine, header string, parent int) (interface{}, error) {
+	literal := header[0] == '|'
+	var chomp byte
+	indent := 0
+
+	detected := false
+	h := header[1:]
+indicators:
+	for len(h) > 0 {
+		switch c := h[0]; {
+		case (c == '-' || c == '+') && chomp == 0:
+			chomp = c
+		case c >= '1' && c <= '9' && !detected:
+			// The indicator counts from the indentation of the parent,
+			// or from the first column for a document that is a scalar
+			indent, detected = int(c-'0'), true
+			if parent > 0 {
+				indent += parent
+			}
+		default:
+			break indicators
+		}
+		h = h[1:]
+	}
+	if rest := strings.TrimSpace(h); rest != "" && (rest[0] != '#' || h[0] != ' ' && h[0] != '\t') {
+		return nil, yamlErrorf(ln.num, "invalid block scalar header %q", header)
+	}
+
+	// Collect the lines indented at least as far as the first, which sets
+	// the indentation of the block unless the header gave it
+	var lines []string
+	i := y.pos
+	for ; i < len(y.lines); i++ {
+		next := y.lines[i]
+		if strings.TrimSpace(next.raw) == "" {
+			// Whitespace past the indentation of the block is text, and
+			// a tab is text wherever it is
+			switch {
+			case detected && next.indent >= indent && len(next.raw) > indent:
+				lines = append(lines, next.raw[indent:])
+				continue
+			case detected || next.text == "" || next.indent <= parent:
+				lines = append(lines, "")
+				continue
+			}
+		}
+		if !detected {
+			if next.indent <= parent {
+				break
+			}
+			indent, detected = next.indent, true
+		}
+		if next.indent < indent {
+			break
+		}
+		lines = append(lines, next.raw[indent:])
+	}
+	y.pos = i
+	// The last line of the block has no line break at the end of input
+	eof := i > 0 && y.lines[i-1].num == y.unterminated
+
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+
+	var body string
+	if literal {
+		body = strings.Join(lines, "\n")
+	} else {
+		body = foldYAMLLines(lines)
+	}
+
+	switch {
+	case chomp == '+':
+		if len(lines) > 0 {
+			body += "\n"
+		}
+		body += strings.Repeat("\n", trailing)
+		if eof {
+			body = strings.TrimSuffix(body, "\n")
+		}
+		return body, nil
+	case chomp == '-' || len(lines) == 0 || eof && trailing == 0:
+		return body, nil
+	}
+	return body + "\n", nil
+}
+
+// foldYAMLLines joins the lines of a folded block scalar. A line break
+// between two lines of text becomes a space, unless blank lines follow it,
+// which each become a newline instead. Lines indented further than the
+// block keep their line breaks.
+func foldYAMLLines(lines []string) string {
+	spaced := func(line string) bool {
+		return line != "" && (line[0] == ' ' || line[0] == '\t')
+	}
+
+	var b strings.Builder
+	for j, line := range lines {
+		if j > 0 {
+			prev := lines[j-1]
+			switch {
+			case prev != "" && !spaced(prev) && line != "" && !spaced(line):
+				b.WriteByte(' ')
+			case prev != "" && !spaced(prev) && line == "":
+				// The break before blank lines is dropped, unless they
+				// lead to a more indented line
+				k := j
+				for k < len(lines) && lines[k] == "" {
+					k++
+				}
+				if k < len(lines) && spaced(lines[k]) {
+					b.WriteByte('\n')
+				}
+			default:
+				b.WriteByte('\n')
+			}
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// flow reads a flow collection that starts with text on line ln and may
+// continue on the lines below until its brackets are closed.
+func (y *yamlReader) flow(ln yamlLine, text string) (interface{}, error) {
+	src, _ := stripFlowComment(text)
+	blanks := 0
+	for {
+		closed, quote := flowState(src)
+		if closed {
+			break
+		}
+		if y.pos >= len(y.lines) {
+			return nil, yamlErrorf(ln.num, "unterminated flow collection")
+		}
+		next := strings.Trim(y.lines[y.pos].raw, " \t")
+		y.pos++
+
+		if quote == 0 {
+			if next, _ = stripFlowComment(next); next != "" {
+				src += " " + next
+			}
+			continue
+		}
+		// A quoted string left open continues on this line
+		if next == "" {
+			blanks++
+			continue
+		}
+		src, _ = stripFlowComment(foldQuoted(src, quote == '"', next, blanks))
+		blanks = 0
+	}
+
+	f := &yamlFlow{src: src, num: ln.num}
+	value, err := f.value()
+	if err != nil {
+		return nil, err
+	}
+	f.space()
+	if f.i < len(f.src) {
+		return nil, yamlErrorf(ln.num, "unexpected %q after flow collection", f.src[f.i:])
+	}
+	return value, nil
+}
+
+// stripFlowComment removes the comment from a line of a flow collection.
+func stripFlowComment(text string) (string, bool) {
+	if _, _, comment := scanFlow(text); comment >= 0 {
+		return strings.TrimSpace(text[:comment]), true
+	}
+	return strings.TrimSpace(text), false
+}
+
+// flowState reports whether every bracket opened in src is closed, or else
+// the quote that opens a string left open at its end, if any.
+func flowState(src string) (closed bool, quote byte) {
+	depth, quote, _ := scanFlow(src)
+	return depth <= 0 && quote == 0, quote
+}
+
+// scanFlow reads the text of a flow collection, skipping quoted strings. It
+// returns the depth of the brackets left open, the quote of a string left
+// open, and the offset of a comment, or -1 if there is none. A quote only
+// starts a string at the start of a scalar, so that the quote in a plain
+// scalar such as it's is kept.
+func scanFlow(src string) (depth int, quote byte, comment int) {
+	start := true
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; {
+		case (c == '"' || c == '\'') && start:
+			end := yamlQuoteEnd(src[i:])
+			if end < 0 {
+				return depth, c, -1
+			}
+			i += end
+			start = false
+		case c == '#' && (i == 0 || src[i-1] == ' ' || src[i-1] == '\t'):
+			return depth, 0, i
+		case c == ' ' || c == '\t' || (c == '?' && start):
+		case c == '[' || c == '{':
+			depth++
+			start = true
+		case c == ']' || c == '}':
+			depth--
+			start = false
+		case c == ',' || c == ':':
+			start = true
+		default:
+			start = false
+		}
+	}
+	return depth, 0, -1
+}
+
+// yamlFlow parses a flow collection held on one line of text.
+type yamlFlow struct {
+	src   string
+	i     int
+	num   int
+	depth int
+}
+
+func (f *yamlFlow) space() {
+	for f.i < len(f.src) && (f.src[f.i] == ' ' || f.src[f.i] == '\t') {
+		f.i++
+	}
+}
+
+func (f *yamlFlow) peek() byte {
+	if f.i < len(f.src) {
+		return f.src[f.i]
+	}
+	return 0
+}
+
+func (f *yamlFlow) value() (interface{}, error) {
+	f.space()
+	switch f.peek() {
+	case 0:
+		return nil, yamlErrorf(f.num, "unexpected end of flow collection")
+	case '[', '{':
+		if f.depth++; f.depth > yamlMaxDepth {
+			return nil, yamlErrorf(f.num, "flow collections are nested too deeply")
+		}
+		defer func() { f.depth-- }()
+		if f.peek() == '[' {
+			return f.sequence()
+		}
+		return f.mapping()
+	case '"', '\'':
+		return f.quoted()
+	case '&', '*', '!':
+		return nil, yamlErrorf(f.num, "anchors, aliases and tags are not supported")
+	}
+
+	s := f.plain()
+	if s == "" {
+		return nil, yamlErrorf(f.num, "expected a value at %q", f.src[f.i:])
+	}
+	return yamlPlain(s), nil
+}
+
+func (f *yamlFlow) sequence() (interface{}, error) {
+	f.i++
+	items := make([]interface{}, 0)
+	for {
+		f.space()
+		if f.peek() == ']' {
+			f.i++
+			return items, nil
+		}
+
+		item, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		f.space()
+		if f.peek() == ':' {
+			return nil, yamlErrorf(f.num, "mappings inside flow sequences are not supported")
+		}
+		items = append(items, item)
+
+		switch f.peek() {
+		case ',':
+			f.i++
+		case ']':
+		default:
+			return nil, yamlErrorf(f.num, "expected , or ] in flow sequence")
+		}
+	}
+}
+
+func (f *yamlFlow) mapping() (interface{}, error) {
+	f.i++
+	obj := newOrderedMap()
+	for {
+		f.space()
+		if f.peek() == '}' {
+			f.i++
+			return obj, nil
+		}
+
+		var key string
+		if c := f.peek(); c == '"' || c == '\'' {
+			k, err := f.quoted()
+			if err != nil {
+				return nil, err
+			}
+			key = k.(string)
+		} else if key = f.plain(); key == "" {
+			return nil, yamlErrorf(f.num, "expected a key in flow mapping")
+		} else if key == "?" || strings.HasPrefix(key, "? ") {
+			return nil, yamlErrorf(f.num, "complex keys are not supported")
+		}
+		if _, dup := obj.values[key]; dup {
+			return nil, yamlErrorf(f.num, "duplicate key %q", key)
+		}
+
+		// A key without a value is null
+		var value interface{}
+		f.space()
+		if f.peek() == ':' {
+			f.i++
+			f.space()
+			if c := f.peek(); c != ',' && c != '}' {
+				var err error
+				if value, err = f.value(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		obj.set(key, value)
+
+		f.space()
+		switch f.peek() {
+		case ',':
+			f.i++
+		case '}':
+		default:
+			return nil, yamlErrorf(f.num, "expected , or } in flow mapping")
+		}
+	}
+}
+
+func (f *yamlFlow) quoted() (interface{}, error) {
+	end := yamlQuoteEnd(f.src[f.i:])
+	if end < 0 {
+		return nil, yamlErrorf(f.num, "unterminated quoted string")
+	}
+	s, err := yamlQuoted(f.num, f.src[f.i:f.i+end+1])
+	f.i += end + 1
+	return s, err
+}
+
+// plain reads a plain scalar, which in a flow collection ends at a flow
+// indicator or at a colon followed by a space.
+func (f *yamlFlow) plain() string {
+	start := f.i
+	for ; f.i < len(f.src); f.i++ {
+		c := f.src[f.i]
+		if strings.IndexByte(",[]{}", c) >= 0 {
+			break
+		}
+		if c == ':' && (f.i+1 == len(f.src) || strings.IndexByte(" \t,[]{}", f.src[f.i+1]) >= 0) {
+			break
+		}
+	}
+	return strings.TrimSpace(f.src[start:f.i])
+}
+
+// yamlQuoteEnd returns the index of the quote that closes the quoted
+// string at the start of s, or -1 if it is not closed.
+func yamlQuoteEnd(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case s[i] == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// yamlEscapes are the single-character escapes of double-quoted strings.
+var yamlEscapes = map[byte]string{
+	'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n",
+	'v': "\v", 'f': "\f", 'r': "\r", 'e': "\x1b", ' ': " ", '"': `"`,
+	'/': "/", '\\': `\`, 'N': "\u0085", '_': "\u00a0", 'L': "\u2028",
+	'P': "\u2029",
+}
+
+// yamlQuoted decodes a single- or double-quoted string, quotes included.
+func yamlQuoted(num int, s string) (string, error) {
+	body := s[1 : len(s)-1]
+	if s[0] == '\'' {
+		return strings.ReplaceAll(body, "''", "'"), nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] != '\\' {
+			b.WriteByte(body[i])
+			continue
+		}
+		i++
+		if esc, ok := yamlEscapes[body[i]]; ok {
+			b.WriteString(esc)
+			continue
+		}
+
+		var n int
+		switch body[i] {
+		case 'x':
+			n = 2
+		case 'u':
+			n = 4
+		case 'U':
+			n = 8
+		default:
+			return "", yamlErrorf(num, "invalid escape \\%c in quoted string", body[i])
+		}
+		if i+n >= len(body)+1 {
+			return "", yamlErrorf(num, "invalid escape \\%s in quoted string", body[i:])
+		}
+		code, err := strconv.ParseUint(body[i+1:i+1+n], 16, 32)
+		if err != nil {
+			return "", yamlErrorf(num, "invalid escape \\%s in quoted string", body[i:i+1+n])
+		}
+		i += n
+
+		r := rune(code)
+		// A character outside the basic plane may be written as a pair
+		// of \u escapes, as in JSON
+		if utf16.IsSurrogate(r) && i+6 < len(body) && body[i+1:i+3] == `\u` {
+			if low, err := strconv.ParseUint(body[i+3:i+7], 16, 32); err == nil {
+				if pair := utf16.DecodeRune(r, rune(low)); pair != utf8.RuneError {
+					r = pair
+					i += 6
+				}
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), nil
+}
+
+// yamlPlain types a plain scalar by the YAML 1.2 core schema. Numbers too
+// large for an int64 are kept exactly as json.Number, and infinities and
+// NaN, which TOON cannot write, become null when converted.
+func yamlPlain(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	case ".inf", ".Inf", ".INF", "+.inf", "+.Inf", "+.INF":
+		return math.Inf(1)
+	case "-.inf", "-.Inf", "-.INF":
+		return math.Inf(-1)
+	case ".nan", ".NaN", ".NAN":
+		return math.NaN()
+	}
+
+	if n, ok := yamlInt(s); ok {
+		return n
+	}
+	if isYAMLFloat(s) {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+	return s
+}
+
+// yamlInt reads a decimal, octal (0o17) or hexadecimal (0xff) integer.
+func yamlInt(s string) (interface{}, bool) {
+	for _, base := range []struct {
+		prefix string
+		base   int
+	}{{"0o", 8}, {"0x", 16}} {
+		if digits := strings.TrimPrefix(s, base.prefix); digits != s {
+			n, err := strconv.ParseInt(digits, base.base, 64)
+			return n, err == nil && digits[0] != '-' && digits[0] != '+'
+		}
+	}
+
+	sign, digits := "", s
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		sign, digits = s[:1], s[1:]
+	}
+	if digits == "" {
+		return nil, false
+	}
+	for i := 0; i < len(digits); i++ {
+		if !isDigit(digits[i]) {
+			return nil, false
+		}
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, true
+	}
+	if digits = strings.TrimLeft(digits, "0"); digits == "" {
+		return int64(0), true
+	}
+	if sign == "+" {
+		sign = ""
+	}
+	return json.Number(sign + digits), true
+}
+
+// isYAMLFloat reports whether s is a float of the core schema, such as
+// 1.5, -.5, 2. or 6e23.
+func isYAMLFloat(s string) bool {
+	i := 0
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		i++
+	}
+	digits := 0
+	for ; i < len(s) && isDigit(s[i]); i++ {
+		digits++
+	}
+	if i < len(s) && s[i] == '.' {
+		for i++; i < len(s) && isDigit(s[i]); i++ {
+			digits++
+		}
+	}
+	if digits == 0 {
+		return false
+	}
+
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '-' || s[i] == '+') {
+			i++
+		}
+		start := i
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		if i == start {
+			return false
+		}
+	}
+	return i == len(s)
+}
+
+// writeYAML writes value as a block node at the start of a line, indented
+// by level.
+func writeYAML(b *strings.Builder, value interface{}, level int) {
+	pad := strings.Repeat("  ", level)
+
+	if keys, fields, ok := objectFields(value, false); ok && len(keys) > 0 {
+		for _, key := range keys {
+			b.WriteString(pad + yamlString(key) + ":")
+			writeYAMLValue(b, fields[key], level)
+		}
+		return
+	}
+
+	if items, ok := arrayItems(value); ok && len(items) > 0 {
+		for _, item := range items {
+			if !blockYAML(item) {
+				b.WriteString(pad + "-")
+				writeYAMLValue(b, item, level)
+				continue
+			}
+			// Start a mapping or sequence on the line of the dash
+			var nested strings.Builder
+			writeYAML(&nested, item, level+1)
+			b.WriteString(pad + "- " + strings.TrimPrefix(nested.String(), pad+"  "))
+		}
+		return
+	}
+
+	b.WriteString(pad + yamlScalar(value) + "\n")
+}
+
+// writeYAMLValue writes the value of a key or sequence item at level, whose
+// line has been started.
+func writeYAMLValue(b *strings.Builder, value interface{}, level int) {
+	if s, ok := value.(string); ok && literalYAML(s) {
+		writeYAMLLiteral(b, s, level+1)
+		return
+	}
+	if blockYAML(value) {
+		b.WriteString("\n")
+		writeYAML(b, value, level+1)
+		return
+	}
+	b.WriteString(" " + yamlScalar(value) + "\n")
+}
+
+// blockYAML reports whether value is written as a block of its own lines:
+// an object or array that is not empty.
+func blockYAML(value interface{}) bool {
+	if keys, _, ok := objectFields(value, false); ok {
+		return len(keys) > 0
+	}
+	items, ok := arrayItems(value)
+	return ok && len(items) > 0
+}
+
+func yamlScalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return yamlString(v)
+	}
+	if isObject(value) {
+		return "{}"
+	}
+	if _, ok := arrayItems(value); ok {
+		return "[]"
+	}
+	return formatPrimitive(value, 0)
+}
+
+// yamlString writes s plain if it reads back as the same string, and
+// double-quoted otherwise.
+func yamlString(s string) string {
+	if plainYAML(s) {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// plainYAML reports whether s can be written as a plain scalar and read
+// back as the same string, by this reader and by YAML 1.1 readers, which
+// also take yes, no, on and off as booleans and more forms as numbers.
+func plainYAML(s string) bool {
+	if s == "" || s != strings.TrimSpace(s) {
+		return false
+	}
+	if _, ok := yamlPlain(s).(string); !ok {
+		return false
+	}
+	switch strings.ToLower(s) {
+	case "y", "n", "yes", "no", "on", "off":
+		return false
+	}
+	if c := s[0]; strings.IndexByte("-?:,[]{}#&*!|>'\"%@`.+~", c) >= 0 || isDigit(c) {
+		return false
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") {
+		return false
+	}
+	for _, r := range s {
+		if r < ' ' || r == 0x7f || r == utf8.RuneError || r == '\ufeff' || r == '\u0085' || r == '\u2028' || r == '\u2029' {
+			return false
+		}
+	}
+	return true
+}
+
+// literalYAML reports whether s is best written as a literal block scalar:
+// it has several lines and nothing that a block scalar would not keep.
+func literalYAML(s string) bool {
+	if !strings.Contains(strings.TrimRight(s, "\n"), "\n") {
+		return false
+	}
+	// The first line of text sets the indentation of the block
+	if text := strings.TrimLeft(s, "\n"); text[0] == ' ' || text[0] == '\t' {
+		return false
+	}
+	for _, line := range strings.Split(s, "\n") {
+		if line != "" && strings.TrimSpace(line) == "" {
+			return false
+		}
+	}
+	for _, r := range s {
+		if (r < ' ' && r != '\n' && r != '\t') || r == 0x7f || r == utf8.RuneError || r == '\ufeff' || r == '\u0085' || r == '\u2028' || r == '\u2029' {
+			return false
+		}
+	}
+	return true
+}
+
+// writeYAMLLiteral writes s as a literal block scalar indented by level,
+// with the chomping indicator that keeps its trailing newlines.
+func writeYAMLLiteral(b *strings.Builder, s string, level int) {
+	body := strings.TrimRight(s, "\n")
+	trailing := len(s) - len(body)
+	switch {
+	case trailing == 0:
+		b.WriteString(" |-\n")
+	case trailing == 1:
+		b.WriteString(" |\n")
+	default:
+		b.WriteString(" |+\n")
+	}
+
+	pad := strings.Repeat("  ", level)
+	for _, line := range strings.Split(body, "\n") {
+		if line == "" {
+			b.WriteString("\n")
+			continue
+		}
+		b.WriteString(pad + line + "\n")
+	}
+	if trailing > 1 {
+		b.WriteString(strings.Repeat("\n", trailing-1))
+	}
+}
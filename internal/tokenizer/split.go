@@ -0,0 +1,123 @@
+package tokenizer
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// split cuts text into the pieces that byte pair encoding works on, as the
+// cl100k pattern of OpenAI's tokenizers does: words with the space or
+// punctuation mark before them, runs of up to three digits, runs of other
+// symbols, and whitespace, of which a line break ends a run and the space
+// before a word goes with the word. No token crosses two pieces.
+func split(text string, piece func(string)) {
+	for i := 0; i < len(text); {
+		n := pieceLen(text[i:])
+		piece(text[i : i+n])
+		i += n
+	}
+}
+
+// pieceLen returns the length in bytes of the piece that starts s.
+func pieceLen(s string) int {
+	r, size := utf8.DecodeRuneInString(s)
+
+	// Contractions, such as 's and 'll
+	if r == '\'' {
+		for _, c := range [...]string{"s", "t", "re", "ve", "m", "ll", "d"} {
+			if len(s) > len(c) && strings.EqualFold(s[1:1+len(c)], c) {
+				return 1 + len(c)
+			}
+		}
+	}
+
+	// A word, after at most one character that is not a line break
+	if isLetter(r) {
+		return size + letters(s[size:])
+	}
+	if !isDigit(r) && r != '\r' && r != '\n' {
+		if next, _ := utf8.DecodeRuneInString(s[size:]); isLetter(next) {
+			return size + letters(s[size:])
+		}
+	}
+
+	if isDigit(r) {
+		n := size
+		for count := 1; count < 3 && n < len(s); count++ {
+			next, size := utf8.DecodeRuneInString(s[n:])
+			if !isDigit(next) {
+				break
+			}
+			n += size
+		}
+		return n
+	}
+
+	// Symbols, after at most one space, with the line breaks after them
+	n := 0
+	if r == ' ' {
+		n = 1
+	}
+	if m := symbols(s[n:]); m > 0 {
+		n += m
+		for n < len(s) && (s[n] == '\r' || s[n] == '\n') {
+			n++
+		}
+		return n
+	}
+
+	// Whitespace, up to its last line break if it has any, and otherwise
+	// short of the last space when a word follows
+	end, lastBreak := 0, -1
+	for end < len(s) {
+		r, size := utf8.DecodeRuneInString(s[end:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		end += size
+		if r == '\r' || r == '\n' {
+			lastBreak = end
+		}
+	}
+	switch {
+	case lastBreak > 0:
+		return lastBreak
+	case end < len(s) && end > size:
+		_, last := utf8.DecodeLastRuneInString(s[:end])
+		return end - last
+	}
+	return end
+}
+
+func letters(s string) int {
+	n := 0
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if !isLetter(r) {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+func symbols(s string) int {
+	n := 0
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if isLetter(r) || isDigit(r) || unicode.IsSpace(r) {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+func isLetter(r rune) bool {
+	return unicode.IsLetter(r)
+}
+
+func isDigit(r rune) bool {
+	return unicode.IsNumber(r)
+}
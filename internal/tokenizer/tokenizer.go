@@ -0,0 +1,228 @@
+// Package tokenizer estimates how many tokens a language model reads a text
+// as, which is what a document costs in a prompt.
+//
+// Texts are split into pieces the way OpenAI's tokenizers split them, and
+// each piece is encoded by byte pair encoding with the ranks of a
+// vocabulary, which Load reads from a local file in the format tiktoken
+// publishes its encodings in, such as cl100k_base.tiktoken. Without a
+// vocabulary, the tokens of each piece are estimated from its length and
+// kind of characters, which is close for English and JSON but only an
+// approximation.
+package tokenizer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxPiece is the longest piece encoded at once. Longer pieces, such as
+// runs of base64, are encoded in parts, since merging a piece takes time
+// that grows with the square of its length.
+const maxPiece = 256
+
+// maxCached is how many pieces a Tokenizer remembers the count of before
+// it starts over.
+const maxCached = 1 << 16
+
+type Tokenizer struct {
+	name string
+	// ranks maps the tokens of the vocabulary to their rank, the order in
+	// which byte pair encoding merges them. It is nil for the estimate.
+	ranks map[string]int
+
+	mu    sync.Mutex
+	cache map[string]int
+}
+
+// New returns a Tokenizer that estimates counts without a vocabulary.
+func New() *Tokenizer {
+	return &Tokenizer{name: "estimate", cache: make(map[string]int)}
+}
+
+// Load reads a vocabulary file and names the Tokenizer after it, without
+// the extension.
+func Load(path string) (*Tokenizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return Parse(name, f)
+}
+
+// Parse reads a vocabulary in the tiktoken format: one token per line, in
+// base64, followed by a space and its rank.
+func Parse(name string, r io.Reader) (*Tokenizer, error) {
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for num := 1; scanner.Scan(); num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("tokenizer: line %d: expected a token and its rank", num)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("tokenizer: line %d: invalid base64 token: %v", num, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil || rank < 0 {
+			return nil, fmt.Errorf("tokenizer: line %d: invalid rank %q", num, fields[1])
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("tokenizer: the vocabulary has no tokens")
+	}
+
+	return &Tokenizer{name: name, ranks: ranks, cache: make(map[string]int)}, nil
+}
+
+// Name returns the name of the vocabulary, or "estimate" without one.
+func (t *Tokenizer) Name() string {
+	return t.name
+}
+
+// Size returns the number of tokens in the vocabulary.
+func (t *Tokenizer) Size() int {
+	return len(t.ranks)
+}
+
+// Count returns the number of tokens text encodes to.
+func (t *Tokenizer) Count(text string) int {
+	total := 0
+	split(text, func(piece string) {
+		for len(piece) > maxPiece {
+			n := maxPiece
+			for n > maxPiece-utf8.UTFMax && !utf8.RuneStart(piece[n]) {
+				n--
+			}
+			total += t.countPiece(piece[:n])
+			piece = piece[n:]
+		}
+		total += t.countPiece(piece)
+	})
+	return total
+}
+
+func (t *Tokenizer) countPiece(piece string) int {
+	t.mu.Lock()
+	n, ok := t.cache[piece]
+	t.mu.Unlock()
+	if ok {
+		return n
+	}
+
+	if t.ranks == nil {
+		n = estimate(piece)
+	} else {
+		n = t.merge(piece)
+	}
+
+	t.mu.Lock()
+	if len(t.cache) >= maxCached {
+		t.cache = make(map[string]int)
+	}
+	t.cache[piece] = n
+	t.mu.Unlock()
+	return n
+}
+
+// merge encodes piece by byte pair encoding and returns the number of
+// tokens it takes. Starting from single bytes, the two neighbouring parts
+// whose joined bytes have the lowest rank are joined, until no two
+// neighbours make a token.
+func (t *Tokenizer) merge(piece string) int {
+	if _, ok := t.ranks[piece]; ok {
+		return 1
+	}
+
+	// parts are the starts of the parts, followed by the end of piece,
+	// each with the rank of the part joined to the next one, if it is a
+	// token, so that a join only looks up the ranks around it
+	type part struct{ start, rank int }
+	const none = math.MaxInt
+	parts := make([]part, len(piece)+1)
+	pairRank := func(i int) int {
+		if i+2 < len(parts) {
+			if rank, ok := t.ranks[piece[parts[i].start:parts[i+2].start]]; ok {
+				return rank
+			}
+		}
+		return none
+	}
+	for i := range parts {
+		parts[i].start = i
+	}
+	for i := range parts {
+		parts[i].rank = pairRank(i)
+	}
+
+	for len(parts) > 2 {
+		at := 0
+		for i := range parts {
+			if parts[i].rank < parts[at].rank {
+				at = i
+			}
+		}
+		if parts[at].rank == none {
+			break
+		}
+
+		parts = append(parts[:at+1], parts[at+2:]...)
+		parts[at].rank = pairRank(at)
+		if at > 0 {
+			parts[at-1].rank = pairRank(at - 1)
+		}
+	}
+	return len(parts) - 1
+}
+
+// estimate guesses the tokens of a piece without a vocabulary, from what
+// vocabularies of about 100k tokens do with each kind of piece: a word
+// takes a token for every four letters or so, a run of whitespace is one
+// token, symbols pair up, and text outside ASCII takes about a token for
+// every two bytes.
+func estimate(piece string) int {
+	ascii := true
+	letters, spaces := 0, 0
+	for i := 0; i < len(piece); i++ {
+		c := piece[i]
+		switch {
+		case c >= utf8.RuneSelf:
+			ascii = false
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9':
+			letters++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			spaces++
+		}
+	}
+
+	switch {
+	case !ascii:
+		return (len(piece) + 1) / 2
+	case spaces == len(piece):
+		return 1
+	case letters > 0:
+		return (letters + 3) / 4
+	}
+	return (len(piece) - spaces + 1) / 2
+}
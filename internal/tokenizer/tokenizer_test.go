@@ -0,0 +1,96 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// vocabulary writes tokens in the tiktoken format, each ranked by its
+// index.
+func vocabulary(tokens ...string) string {
+	var b strings.Builder
+	for rank, token := range tokens {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), rank)
+	}
+	return b.String()
+}
+
+func TestMerge(t *testing.T) {
+	tok, err := Parse("test", strings.NewReader(vocabulary("bc", "ab", "cd", " x", "xy", "xyz")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Name() != "test" || tok.Size() != 6 {
+		t.Fatalf("got %s of %d tokens", tok.Name(), tok.Size())
+	}
+
+	for _, tc := range []struct {
+		piece string
+		want  int
+	}{
+		// bc is merged first, which leaves a and d on their own, though
+		// ab and cd would have made two tokens
+		{"abcd", 3},
+		{"ab", 1},
+		{"abab", 2},
+		{"dcba", 4},
+		{" xy", 2},
+		{"xyz", 1},
+		{"", 0},
+	} {
+		if got := tok.merge(tc.piece); got != tc.want {
+			t.Errorf("merge(%q) = %d, want %d", tc.piece, got, tc.want)
+		}
+	}
+
+	// Count adds up the pieces, each merged on its own
+	if got := tok.Count("abcd ab"); got != 5 {
+		t.Errorf("Count = %d, want 5", got)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want []string
+	}{
+		{"hello world", []string{"hello", " world"}},
+		{"I'll don't", []string{"I", "'ll", " don", "'t"}},
+		{"WE'RE", []string{"WE", "'RE"}},
+		{"12345", []string{"123", "45"}},
+		{"id: 42", []string{"id", ":", " ", "42"}},
+		{"a   b", []string{"a", "  ", " b"}},
+		{"x\n\n  y", []string{"x", "\n\n", " ", " y"}},
+		{"end.\n", []string{"end", ".\n"}},
+		{" (x)", []string{" (", "x", ")"}},
+		{"héllo wörld", []string{"héllo", " wörld"}},
+		{"trailing  ", []string{"trailing", "  "}},
+	} {
+		var got []string
+		split(tc.text, func(piece string) { got = append(got, piece) })
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("split(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		vocabulary string
+		want       string
+	}{
+		{"YWI= 0 1\n", "line 1: expected a token and its rank"},
+		{"YWI= 0\n!!! 1\n", "line 2: invalid base64 token"},
+		{"YWI= x\n", `line 1: invalid rank "x"`},
+		{"YWI= -1\n", `line 1: invalid rank "-1"`},
+		{"\n\n", "the vocabulary has no tokens"},
+	} {
+		_, err := Parse("test", strings.NewReader(tc.vocabulary))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Parse(%q) returned %v, want an error containing %q", tc.vocabulary, err, tc.want)
+		}
+	}
+}